@@ -1,8 +1,12 @@
 package main
 
 import (
+	"github.com/EnderCHX/DSMS-go/internal/dstp"
 	"github.com/EnderCHX/DSMS-go/internal/message_hub"
 	"github.com/joho/godotenv"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -10,7 +14,31 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	hub := message_hub.NewHub("0.0.0.0", "1314")
+	// 设置 DSTP_TLS 后 hub 只接受 TLS 连接，见 dstp.TLSOptionsFromEnv
+	var opts message_hub.HubOptions
+	if tlsOpts, ok := dstp.TLSOptionsFromEnv(); ok {
+		opts.TLS, err = dstp.ServerTLSConfig(tlsOpts)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// 设置 HUB_WS_ADDR 后同时在该地址的 /dstp 上接受浏览器的 WebSocket 连接
+	opts.WebSocketAddr = os.Getenv("HUB_WS_ADDR")
+	if origins := os.Getenv("HUB_WS_ORIGINS"); origins != "" {
+		opts.WebSocketOrigins = strings.Split(origins, ",")
+	}
+	// 设置 HUB_UDP_ADDR 后同时在该 UDP 地址上接受客户端
+	opts.UDPAddr = os.Getenv("HUB_UDP_ADDR")
+	// 设置 HUB_STATS_INTERVAL(如 1m)后定期在日志中输出每个连接的统计信息
+	if interval := os.Getenv("HUB_STATS_INTERVAL"); interval != "" {
+		opts.StatsInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// 设置 HUB_TRACE_FRAMES 后在 debug 日志中记录每个数据包
+	opts.TraceFrames = os.Getenv("HUB_TRACE_FRAMES") != ""
+	hub := message_hub.NewHubWithOptions("0.0.0.0", "1314", opts)
 	hub.Run()
 
 	select {}
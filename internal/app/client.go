@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"fmt"
@@ -36,13 +37,21 @@ func init() {
 }
 
 func connectServer(ip, port string) error {
-	conn, err := net.Dial("tcp", ip+":"+port)
+	// 设置 DSTP_TLS 时使用 TLS 连接，见 dstp.TLSOptionsFromEnv
+	var tlsConfig *tls.Config
+	var err error
+	if tlsOpts, ok := dstp.TLSOptionsFromEnv(); ok {
+		tlsConfig, err = dstp.ClientTLSConfig(tlsOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err = dstp.Dial("tcp", net.JoinHostPort(ip, port), tlsConfig)
 	if err != nil {
 		return err
 	}
 
-	client = dstp.NewConn(&conn)
-
 	go read()
 	go write()
 	go handleMsg()
@@ -62,7 +71,7 @@ func read() {
 				return
 			}
 		}
-		if type_ != 1 {
+		if type_ != dstp.FrameMessage {
 			continue
 		}
 
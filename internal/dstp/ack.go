@@ -0,0 +1,122 @@
+package dstp
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingAck 一条等待应答的消息
+type pendingAck struct {
+	ctrl     byte
+	data     []byte      // 发送的数据，压缩时为压缩后的数据
+	stream   *streamInfo // 重传时沿用原来的流头和分块
+	priority Priority
+	policy   RetryPolicy
+	onResult func(messageId uint32, err error)
+	sentAt   time.Time // 首次写出的时间，用于计算应答延迟
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newPendingAck(ctrl byte, data []byte, stream *streamInfo, priority Priority, policy RetryPolicy, onResult func(uint32, error)) *pendingAck {
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultRetryPolicy().Backoff
+	}
+	return &pendingAck{
+		ctrl:     ctrl,
+		data:     data,
+		stream:   stream,
+		priority: priority,
+		policy:   policy,
+		onResult: onResult,
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *pendingAck) resolve(messageId uint32, err error) {
+	p.once.Do(func() {
+		close(p.done)
+		if p.onResult != nil {
+			p.onResult(messageId, err)
+		}
+	})
+}
+
+// resolvePending 结束等待应答，err 为 nil 表示已送达
+func (c *Conn) resolvePending(messageId uint32, err error) {
+	c.pendingMtx.Lock()
+	p, ok := c.pending[messageId]
+	delete(c.pending, messageId)
+	c.notifyDrained()
+	c.pendingMtx.Unlock()
+	if ok && err == nil {
+		c.onAck(messageId, p)
+	}
+	if ok {
+		p.resolve(messageId, err)
+	}
+}
+
+// dropPending 消息没有完整写出时取消等待应答，不通知调用方
+func (c *Conn) dropPending(messageId uint32) {
+	c.pendingMtx.Lock()
+	delete(c.pending, messageId)
+	c.notifyDrained()
+	c.pendingMtx.Unlock()
+}
+
+// retryPolicy 返回消息的重传策略，没有单独设置时使用连接的策略
+func (c *Conn) retryPolicy(opts SendOptions) RetryPolicy {
+	if opts.Retry != nil {
+		return *opts.Retry
+	}
+	return c.opts.Retry
+}
+
+// failPending 连接关闭时结束所有等待应答的消息
+func (c *Conn) failPending(err error) {
+	c.pendingMtx.Lock()
+	pending := c.pending
+	c.pending = make(map[uint32]*pendingAck)
+	c.notifyDrained()
+	c.pendingMtx.Unlock()
+	for messageId, p := range pending {
+		p.resolve(messageId, err)
+	}
+}
+
+// retransmit 按重传策略重发消息，直到收到应答或放弃
+func (c *Conn) retransmit(messageId uint32, p *pendingAck) {
+	backoff := p.policy.Backoff
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	var deadline <-chan time.Time
+	if p.policy.Timeout > 0 {
+		t := time.NewTimer(p.policy.Timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	for retries := 0; ; retries++ {
+		select {
+		case <-p.done:
+			return
+		case <-deadline:
+			c.resolvePending(messageId, ErrAckTimeout)
+			return
+		case <-timer.C:
+		}
+		if retries >= p.policy.MaxRetries {
+			c.resolvePending(messageId, ErrAckTimeout)
+			return
+		}
+		c.onRetransmit(messageId, retries+1)
+		if err := c.resendData(p, messageId); err != nil {
+			c.resolvePending(messageId, err)
+			return
+		}
+		backoff = p.policy.next(backoff)
+		timer.Reset(backoff)
+	}
+}
@@ -0,0 +1,350 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ClientState 重连客户端的连接状态
+type ClientState int
+
+const (
+	ClientConnecting   ClientState = iota // 正在建立第一次连接
+	ClientConnected                       // 已连接，会话消息已重发
+	ClientReconnecting                    // 连接断开，正在按退避时间重连
+	ClientClosed                          // 已调用 Close，不再重连
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnecting:
+		return "connecting"
+	case ClientConnected:
+		return "connected"
+	case ClientReconnecting:
+		return "reconnecting"
+	case ClientClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ClientState(%d)", int(s))
+	}
+}
+
+// ClientOptions 重连客户端的选项
+type ClientOptions struct {
+	// Dial 建立连接并完成握手，第一次连接和每次重连都会调用
+	Dial func(ctx context.Context) (*Conn, error)
+	// MinBackoff 第一次重连前的等待时间，之后每次失败翻倍，不超过 MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnStateChange 连接状态变化时在客户端的协程中调用，err 为断开或重连失败的原因
+	OnStateChange func(state ClientState, err error)
+}
+
+// 重连的默认退避时间
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// 接收队列长度，应用处理较慢时接收协程等待
+const clientRecvQueueSize = 64
+
+// Client 断线后自动重连的客户端
+// 重连后先按设置顺序重发会话消息(登录、订阅等)，再重发没有收到应答的消息
+// 不需要应答的消息在断线期间直接丢弃，返回 ErrNotConnected
+// 应答在断线时丢失的消息会被重发，对方可能收到两次
+type Client struct {
+	opts   ClientOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+	recv   chan []byte
+	done   chan struct{} // 客户端停止后关闭
+
+	mtx      sync.Mutex
+	conn     *Conn // 断线期间为 nil
+	state    ClientState
+	sessions []session
+	unacked  []*outgoing // 按发送顺序排列
+}
+
+// session 重连后需要重发的会话消息
+type session struct {
+	key  string
+	data []byte
+}
+
+// outgoing 需要应答、还没有收到应答的消息
+type outgoing struct {
+	data   []byte
+	opts   SendOptions
+	conn   *Conn      // 最近一次发出时使用的连接
+	result chan error // 收到应答或放弃时写入
+}
+
+// DialClient 建立第一次连接并启动客户端，第一次连接失败时直接返回错误，不重试
+func DialClient(ctx context.Context, opts ClientOptions) (*Client, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	c := &Client{
+		opts:  opts,
+		recv:  make(chan []byte, clientRecvQueueSize),
+		done:  make(chan struct{}),
+		state: ClientConnecting,
+	}
+	c.notify(ClientConnecting, nil)
+	conn, err := opts.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run(conn)
+	return c, nil
+}
+
+// run 接收消息，断线后重连，直到 Close
+func (c *Client) run(conn *Conn) {
+	defer close(c.done)
+	for {
+		// 接收协程先启动，重发期间的应答和窗口通告才能被处理
+		errc := make(chan error, 1)
+		go func() { errc <- c.receive(conn) }()
+		c.resume(conn)
+		c.setState(ClientConnected, nil)
+
+		err := <-errc
+		c.mtx.Lock()
+		c.conn = nil
+		c.mtx.Unlock()
+		conn.Close()
+		if c.ctx.Err() != nil {
+			break
+		}
+		c.setState(ClientReconnecting, err)
+		if conn = c.redial(); conn == nil {
+			break
+		}
+	}
+	c.setState(ClientClosed, nil)
+	c.mtx.Lock()
+	for _, o := range c.unacked {
+		o.result <- ErrClosed
+	}
+	c.unacked = nil
+	c.mtx.Unlock()
+}
+
+// receive 把收到的消息放入接收队列，连接出错时返回
+func (c *Client) receive(conn *Conn) error {
+	var f Frame
+	for {
+		if err := conn.ReceiveFrame(c.ctx, &f); err != nil {
+			return err
+		}
+		if f.Type != FrameMessage {
+			continue
+		}
+		select {
+		case c.recv <- slices.Clone(f.Payload):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// redial 按退避时间重连，Close 后返回 nil
+func (c *Client) redial() *Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		conn, err := c.opts.Dial(c.ctx)
+		if err == nil {
+			return conn
+		}
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		c.setState(ClientReconnecting, err)
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// resume 在新的连接上重发会话消息和没有收到应答的消息
+// 持有锁直到重发完成，新发送的消息排在重发的消息之后
+func (c *Client) resume(conn *Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn = conn
+	for _, s := range c.sessions {
+		conn.SendWithOptions(s.data, SendOptions{NeedAck: true})
+	}
+	for _, o := range c.unacked {
+		c.sendLocked(conn, o)
+	}
+}
+
+// sendLocked 在 conn 上发出需要应答的消息
+func (c *Client) sendLocked(conn *Conn, o *outgoing) {
+	o.conn = conn
+	opts := o.opts
+	// 应答在接收协程中回调，重发期间持有锁，不能在回调中直接加锁
+	opts.OnResult = func(_ uint32, err error) { go c.onResult(o, conn, err) }
+	if _, err := conn.SendWithOptions(o.data, opts); err != nil && !errors.Is(err, ErrClosed) {
+		c.finishLocked(o, err)
+	}
+}
+
+// onResult 处理应答结果，连接断开导致的失败等待重连后重发
+func (c *Client) onResult(o *outgoing, conn *Conn, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err != nil && (errors.Is(err, ErrClosed) || o.conn != conn) {
+		return
+	}
+	c.finishLocked(o, err)
+}
+
+// finishLocked 结束等待应答的消息
+func (c *Client) finishLocked(o *outgoing, err error) {
+	i := slices.Index(c.unacked, o)
+	if i < 0 {
+		return
+	}
+	c.unacked = slices.Delete(c.unacked, i, i+1)
+	o.result <- err
+}
+
+// setState 记录并通知状态变化，只在客户端的协程中调用
+func (c *Client) setState(state ClientState, err error) {
+	c.mtx.Lock()
+	changed := c.state != state
+	c.state = state
+	c.mtx.Unlock()
+	if changed || err != nil {
+		c.notify(state, err)
+	}
+}
+
+func (c *Client) notify(state ClientState, err error) {
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state, err)
+	}
+}
+
+// State 返回当前的连接状态
+func (c *Client) State() ClientState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.state
+}
+
+// Conn 返回当前的连接，断线期间为 nil
+func (c *Client) Conn() *Conn {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn
+}
+
+// Send 发送消息
+// 需要应答的消息在断线期间排队，重连后重发直到收到应答，opts.OnResult 被忽略，需要结果时使用 SendAndWait
+// 不需要应答的消息在断线期间返回 ErrNotConnected
+func (c *Client) Send(data []byte, opts SendOptions) error {
+	if opts.NeedAck {
+		c.sendAcked(data, opts)
+		return nil
+	}
+	conn := c.Conn()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	_, err := conn.SendWithOptions(data, opts)
+	return err
+}
+
+// SendAndWait 发送需要应答的消息并等待应答，断线期间继续等待重连后重发
+// ctx 结束时不再重发并返回 ctx.Err()
+func (c *Client) SendAndWait(ctx context.Context, data []byte, opts SendOptions) error {
+	opts.NeedAck = true
+	o := c.sendAcked(data, opts)
+	select {
+	case err := <-o.result:
+		return err
+	case <-ctx.Done():
+		c.mtx.Lock()
+		if i := slices.Index(c.unacked, o); i >= 0 {
+			c.unacked = slices.Delete(c.unacked, i, i+1)
+		}
+		c.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (c *Client) sendAcked(data []byte, opts SendOptions) *outgoing {
+	o := &outgoing{data: slices.Clone(data), opts: opts, result: make(chan error, 1)}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.state == ClientClosed {
+		o.result <- ErrClosed
+		return o
+	}
+	c.unacked = append(c.unacked, o)
+	if c.conn != nil {
+		c.sendLocked(c.conn, o)
+	}
+	return o
+}
+
+// SetSession 设置会话消息并在已连接时立即发送，每次重连后按设置顺序重发
+// 用于登录和订阅，相同 key 的消息被替换并保持原来的顺序
+func (c *Client) SetSession(key string, data []byte) {
+	data = slices.Clone(data)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if i := slices.IndexFunc(c.sessions, func(s session) bool { return s.key == key }); i >= 0 {
+		c.sessions[i].data = data
+	} else {
+		c.sessions = append(c.sessions, session{key: key, data: data})
+	}
+	if c.conn != nil {
+		c.conn.SendWithOptions(data, SendOptions{NeedAck: true})
+	}
+}
+
+// DeleteSession 删除会话消息，之后重连时不再重发
+func (c *Client) DeleteSession(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.sessions = slices.DeleteFunc(c.sessions, func(s session) bool { return s.key == key })
+}
+
+// Receive 接收下一条消息，跨越重连，Close 后返回 ErrClosed
+func (c *Client) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-c.recv:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close 关闭连接并停止重连，没有收到应答的消息以 ErrClosed 结束
+func (c *Client) Close() {
+	c.cancel()
+	<-c.done
+}
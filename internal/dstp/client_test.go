@@ -0,0 +1,131 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientReconnect(t *testing.T) {
+	// 每次连接的服务端，第一个连接收到 "login" 后停止读取，之后的消息不会被应答
+	type accepted struct {
+		conn *Conn
+		got  chan string
+	}
+	servers := make(chan accepted, 4)
+	var dials atomic.Int32
+	dial := func(ctx context.Context) (*Conn, error) {
+		client, server := Pipe()
+		a := accepted{conn: server, got: make(chan string, 16)}
+		first := dials.Add(1) == 1
+		go func() {
+			defer close(a.got)
+			var f Frame
+			for {
+				if err := server.ReceiveFrame(context.Background(), &f); err != nil {
+					return
+				}
+				if f.Type == FrameMessage {
+					a.got <- string(f.Payload)
+					if first && string(f.Payload) == "login" {
+						return
+					}
+				}
+			}
+		}()
+		if _, err := client.Handshake(ctx); err != nil {
+			return nil, err
+		}
+		servers <- a
+		return client, nil
+	}
+	states := make(chan ClientState, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := DialClient(ctx, ClientOptions{
+		Dial:          dial,
+		MinBackoff:    10 * time.Millisecond,
+		OnStateChange: func(state ClientState, err error) { states <- state },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	waitState := func(want ClientState) {
+		t.Helper()
+		for {
+			select {
+			case s := <-states:
+				if s == want {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("never reached %v", want)
+			}
+		}
+	}
+	waitState(ClientConnected)
+
+	first := <-servers
+	client.SetSession("login", []byte("login"))
+	client.SetSession("subscribe", []byte("subscribe"))
+	if got := <-first.got; got != "login" {
+		t.Fatalf("got %q", got)
+	}
+	// 第一个服务端不再读取，需要应答的消息等待重连后重发
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendAndWait(ctx, []byte("important"), SendOptions{}) }()
+	for client.State() != ClientConnected || len(client.unackedSnapshot()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	first.conn.Close()
+	waitState(ClientReconnecting)
+	if err := client.Send([]byte("dropped"), SendOptions{}); err != nil && !errors.Is(err, ErrNotConnected) {
+		t.Fatal(err)
+	}
+	waitState(ClientConnected)
+
+	second := <-servers
+	for _, want := range []string{"login", "subscribe", "important"} {
+		if got := <-second.got; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	// 对方发来的消息跨越重连交付
+	go second.conn.Send([]byte("hello"), false)
+	data, err := client.Receive(ctx)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	client.Close()
+	if _, err := client.Receive(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if err := client.SendAndWait(ctx, []byte("late"), SendOptions{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
+
+// unackedSnapshot 返回还没有收到应答的消息，供测试观察
+func (c *Client) unackedSnapshot() []*outgoing {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]*outgoing(nil), c.unacked...)
+}
+
+func TestClientDialError(t *testing.T) {
+	errDial := errors.New("refused")
+	_, err := DialClient(context.Background(), ClientOptions{
+		Dial: func(ctx context.Context) (*Conn, error) { return nil, errDial },
+	})
+	if !errors.Is(err, errDial) {
+		t.Fatalf("got %v, want %v", err, errDial)
+	}
+}
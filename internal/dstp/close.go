@@ -0,0 +1,162 @@
+package dstp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CloseCode CLOSE 扩展包携带的关闭原因
+type CloseCode uint16
+
+const (
+	CloseNormal          CloseCode = 0 // 发送完所有消息后正常关闭
+	CloseGoingAway       CloseCode = 1 // 没有等待消息送达，直接关闭
+	CloseProtocolError   CloseCode = 2 // 对方违反协议或握手不兼容
+	ClosePolicyViolation CloseCode = 3 // 对方违反应用层的规则，例如登录超时
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNormal:
+		return "normal"
+	case CloseGoingAway:
+		return "going away"
+	case CloseProtocolError:
+		return "protocol error"
+	case ClosePolicyViolation:
+		return "policy violation"
+	default:
+		return fmt.Sprintf("CloseCode(%d)", uint16(c))
+	}
+}
+
+// CLOSE 扩展包: |extClose|关闭原因(2)|说明(UTF-8)|
+// 收到 CLOSE 的一端回复一个 CLOSE 后关闭连接，之后的 Receive 返回 io.EOF
+// 只在握手完成后发送，没有握手的连接关闭时直接断开，对方读到 io.EOF
+
+// 说明文字的最大长度，超出部分被截断
+const maxCloseReason = 123
+
+// closeInfo 对方发来的关闭原因
+type closeInfo struct {
+	code   CloseCode
+	reason string
+}
+
+// sendClose 写出 CLOSE 扩展包，每个连接只写出一次
+// 连接此时可能已经标记为关闭，直接获取写锁而不经过 lockWrite
+func (c *Conn) sendClose(ctx context.Context, code CloseCode, reason string) error {
+	if _, ok := c.Features(); !ok || !c.closeSent.CompareAndSwap(false, true) {
+		return nil
+	}
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	body := binary.BigEndian.AppendUint16([]byte{extClose}, uint16(code))
+	body = append(body, reason...)
+	e := c.encoder()
+	defer putEncoder(e)
+	e.data(ctrlExt, 0, body)
+	if err := c.writeMtx.lock(ctx, priorityInternal); err != nil {
+		return err
+	}
+	defer c.writeMtx.unlock()
+	return c.write(ctx, e)
+}
+
+// onClose 对方关闭连接，回复 CLOSE 后关闭本端
+func (c *Conn) onClose(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("%w: short close", ErrHandshake)
+	}
+	c.peerClose.Store(&closeInfo{
+		code:   CloseCode(binary.BigEndian.Uint16(data)),
+		reason: string(data[2:]),
+	})
+	c.closeWith(CloseNormal, io.EOF)
+	return io.EOF
+}
+
+// waitDrain 等待所有需要应答的消息收到应答或放弃重传
+func (c *Conn) waitDrain(ctx context.Context) error {
+	c.pendingMtx.Lock()
+	if len(c.pending) == 0 {
+		c.pendingMtx.Unlock()
+		return nil
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	drained := c.drained
+	c.pendingMtx.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyDrained 在持有 pendingMtx 时调用，等待应答的消息全部结束后通知 waitDrain
+func (c *Conn) notifyDrained() {
+	if len(c.pending) == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// Shutdown 以 CloseNormal 关闭连接，见 ShutdownWithReason
+func (c *Conn) Shutdown(ctx context.Context) error {
+	return c.ShutdownWithReason(ctx, CloseNormal, "")
+}
+
+// ShutdownWithReason 优雅地关闭连接
+// 不再接受新的消息，等待已发出的需要应答的消息收到应答后发送 CLOSE，对方回复 CLOSE 后关闭连接
+// 应答和对方的 CLOSE 由 Receive 处理，调用期间需要有其他协程在接收数据
+// ctx 结束时直接关闭连接并返回 ctx.Err()，还没有收到应答的消息以 ErrClosed 结束
+func (c *Conn) ShutdownWithReason(ctx context.Context, code CloseCode, reason string) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	c.closing.Store(true)
+	err := c.waitDrain(ctx)
+	if err == nil {
+		err = c.sendClose(ctx, code, reason)
+	}
+	if _, ok := c.Features(); ok && err == nil {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	c.closeWith(code, nil)
+	if err == ErrClosed {
+		// 等待期间对方先关闭了连接
+		return nil
+	}
+	return err
+}
+
+// CloseWithReason 立即关闭连接，握手完成时先尽量发出带原因的 CLOSE
+func (c *Conn) CloseWithReason(code CloseCode, reason string) {
+	if c.closed.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeWriteTimeout)
+	c.sendClose(ctx, code, reason)
+	cancel()
+	c.closeWith(code, nil)
+}
+
+// PeerCloseReason 返回对方 CLOSE 中的关闭原因，对方没有发送 CLOSE 时 ok 为 false
+func (c *Conn) PeerCloseReason() (code CloseCode, reason string, ok bool) {
+	if info := c.peerClose.Load(); info != nil {
+		return info.code, info.reason, true
+	}
+	return 0, "", false
+}
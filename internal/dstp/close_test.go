@@ -0,0 +1,110 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 50, Backoff: 20 * time.Millisecond}
+	sender, receiver := PipeWithOptions(PipeOptions{Loss: 0.2, Seed: 5}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	got := make(chan []byte, 8)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			data, type_, err := receiver.Receive()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			if type_ == FrameMessage {
+				got <- data
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+	}()
+
+	for i := range 3 {
+		if err := sender.Send([]byte{byte(i)}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 丢失的消息重传成功后才发送 CLOSE
+	if err := sender.ShutdownWithReason(ctx, ClosePolicyViolation, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if s := sender.Stats(); s.PendingAcks != 0 {
+		t.Fatalf("%d pending acks after shutdown", s.PendingAcks)
+	}
+	if err := sender.Send([]byte{3}, false); !errors.Is(err, ErrClosed) {
+		t.Fatalf("send after shutdown: %v", err)
+	}
+	for i := range 3 {
+		if data := <-got; len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("got %v, want %d", data, i)
+		}
+	}
+	if err := <-recvErr; err != io.EOF {
+		t.Fatalf("receiver got %v, want io.EOF", err)
+	}
+	code, reason, ok := receiver.PeerCloseReason()
+	if !ok || code != ClosePolicyViolation || reason != "bye" {
+		t.Fatalf("peer close %v %q %v", code, reason, ok)
+	}
+	// 对方回复的 CLOSE 可能丢失，本端读到连接断开时同样返回 io.EOF
+	if err := <-sendErr; err != io.EOF {
+		t.Fatalf("sender got %v, want io.EOF", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// 对方不读取数据时 Shutdown 在 ctx 结束后直接关闭连接
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	sender := NewConn(&c1)
+	sender.features.Store(&Features{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sender.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if !sender.IsClosed() {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestCloseWithoutHandshake(t *testing.T) {
+	// 没有握手的连接关闭时不写出任何数据，对方读到 io.EOF 而不是格式错误
+	c1, c2 := net.Pipe()
+	a, b := NewConn(&c1), NewConn(&c2)
+	defer b.Close()
+	a.Close()
+	if _, _, err := b.Receive(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if _, _, ok := b.PeerCloseReason(); ok {
+		t.Fatal("unexpected close reason")
+	}
+}
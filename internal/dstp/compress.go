@@ -0,0 +1,221 @@
+package dstp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec 数据压缩算法
+// 压缩后的数据前面加 1 字节 Id，接收方据此选择解压算法，因此收发双方都要注册同一个 Codec
+type Codec interface {
+	Id() byte
+	Name() string
+	// Compress 压缩 src 并追加到 dst 后面
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress 解压 src 并追加到 dst 后面，解压出的数据超过 limit 字节时返回 ErrFrameTooLarge
+	// limit 为 0 表示不限制
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+// CompressionOptions 发送时的压缩选项
+type CompressionOptions struct {
+	Codec     Codec // 为 nil 时不压缩
+	Threshold int   // 数据长度不小于该值时才压缩
+	// 默认只在握手协商出压缩能力后压缩，没有握手的旧客户端收到的数据不压缩
+	// Force 为 true 时没有握手也压缩，只用于确定对方支持压缩的场景
+	Force bool
+}
+
+var (
+	codecsMtx sync.RWMutex
+	codecs    = map[byte]Codec{}
+)
+
+// RegisterCodec 注册压缩算法，Id 相同时覆盖之前注册的算法
+func RegisterCodec(codec Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[codec.Id()] = codec
+}
+
+func lookupCodec(id byte) Codec {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	return codecs[id]
+}
+
+func init() {
+	RegisterCodec(NoopCodec{})
+	RegisterCodec(DeflateCodec{Level: flate.DefaultCompression})
+	RegisterCodec(GzipCodec{Level: gzip.DefaultCompression})
+}
+
+// NoopCodec 不压缩，用于测试和对比
+type NoopCodec struct{}
+
+func (NoopCodec) Id() byte     { return 0 }
+func (NoopCodec) Name() string { return "noop" }
+
+func (NoopCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (NoopCodec) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	if limit > 0 && len(src) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, limit)
+	}
+	return append(dst, src...), nil
+}
+
+// DeflateCodec 标准库 DEFLATE，Level 同 compress/flate
+type DeflateCodec struct {
+	Level int
+}
+
+func (DeflateCodec) Id() byte     { return 1 }
+func (DeflateCodec) Name() string { return "deflate" }
+
+func (c DeflateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	pool := writerPool(&flateWriters, c.Level, func(level int) (resetWriter, error) {
+		return flate.NewWriter(nil, level)
+	})
+	return compress(pool, buf, src, c.Level)
+}
+
+func (DeflateCodec) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return decompress(dst, r, limit)
+}
+
+// GzipCodec 标准库 gzip，Level 同 compress/gzip
+type GzipCodec struct {
+	Level int
+}
+
+func (GzipCodec) Id() byte     { return 2 }
+func (GzipCodec) Name() string { return "gzip" }
+
+func (c GzipCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	pool := writerPool(&gzipWriters, c.Level, func(level int) (resetWriter, error) {
+		return gzip.NewWriterLevel(nil, level)
+	})
+	return compress(pool, buf, src, c.Level)
+}
+
+func (GzipCodec) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return decompress(dst, r, limit)
+}
+
+// resetWriter flate.Writer 和 gzip.Writer 共同的方法
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// 压缩器创建开销很大，按压缩级别复用 key: level, value: *sync.Pool
+var flateWriters, gzipWriters sync.Map
+
+func writerPool(pools *sync.Map, level int, newWriter func(level int) (resetWriter, error)) *sync.Pool {
+	if pool, ok := pools.Load(level); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := pools.LoadOrStore(level, &sync.Pool{
+		New: func() any {
+			w, err := newWriter(level)
+			if err != nil {
+				return err
+			}
+			return w
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+func compress(pool *sync.Pool, buf *bytes.Buffer, src []byte, level int) ([]byte, error) {
+	v := pool.Get()
+	w, ok := v.(resetWriter)
+	if !ok {
+		return nil, fmt.Errorf("dstp: compression level %d: %w", level, v.(error))
+	}
+	defer pool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress 读取解压后的数据追加到 dst 后面，最多读取 limit+1 字节用于判断是否超限
+func decompress(dst []byte, r io.Reader, limit int) ([]byte, error) {
+	if limit > 0 {
+		r = io.LimitReader(r, int64(limit)+1)
+	}
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if limit > 0 && buf.Len()-len(dst) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, limit)
+	}
+	return buf.Bytes(), nil
+}
+
+// compressPayload 按选项压缩要发送的数据，返回的数据以 Codec Id 开头
+// 数据太短或压缩后没有变小时返回 false
+func (c *Conn) compressPayload(data []byte) ([]byte, bool, error) {
+	opts := c.opts.Compression
+	if opts.Codec == nil || len(data) < opts.Threshold || len(data) == 0 {
+		return data, false, nil
+	}
+	if f := c.features.Load(); f == nil && !opts.Force || f != nil && !f.Capabilities.Has(CapCompression) {
+		return data, false, nil
+	}
+	out, err := opts.Codec.Compress([]byte{opts.Codec.Id()}, data)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(out) >= len(data) {
+		return data, false, nil
+	}
+	return out, true, nil
+}
+
+// decompressPayload 将 f.Payload 原地替换为解压后的数据，f.Payload 的内存会被复用
+func (c *Conn) decompressPayload(f *Frame) error {
+	if len(f.Payload) == 0 {
+		return fmt.Errorf("%w: empty payload", ErrCompression)
+	}
+	codec := lookupCodec(f.Payload[0])
+	if codec == nil {
+		return fmt.Errorf("%w: unknown codec %d", ErrCompression, f.Payload[0])
+	}
+	c.zbuf = append(c.zbuf[:0], f.Payload[1:]...)
+	out, err := codec.Decompress(f.Payload[:0], c.zbuf, c.opts.Limits.MaxMessageSize)
+	if len(c.zbuf) > maxPooledBufCap {
+		c.zbuf = nil
+	}
+	if err != nil {
+		if errors.Is(err, ErrFrameTooLarge) {
+			return err
+		}
+		return fmt.Errorf("%w: %s: %v", ErrCompression, codec.Name(), err)
+	}
+	f.Payload = out
+	return nil
+}
@@ -0,0 +1,327 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readerConn 从固定的字节读取数据的 net.Conn，写入的应答被丢弃
+type readerConn struct {
+	r io.Reader
+}
+
+func newReaderConn(raw []byte) net.Conn {
+	return &readerConn{r: bytes.NewReader(raw)}
+}
+
+func (c *readerConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readerConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *readerConn) Close() error                       { return nil }
+func (c *readerConn) LocalAddr() net.Addr                { return readerAddr }
+func (c *readerConn) RemoteAddr() net.Addr               { return readerAddr }
+func (c *readerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var readerAddr = &net.UnixAddr{Name: "reader", Net: "pipe"}
+
+// unhex 解析带空格的十六进制字符串
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// goldenFrame 固定的线上格式，编码结果和解码结果都要与之一致
+type goldenFrame struct {
+	name   string
+	encode func(e *frameEncoder)
+	raw    []byte
+	frame  Frame // 解码后期望的数据包，ack 包的 Payload 为被应答的消息id
+}
+
+func goldenFrames() []goldenFrame {
+	segmented := bytes.Repeat([]byte{'a'}, maxSegmentLen+1)
+	segmentedRaw := unhex("01 01 00000004 ffff")
+	segmentedRaw = append(segmentedRaw, segmented[:maxSegmentLen]...)
+	segmentedRaw = append(segmentedRaw, unhex("02 0001 61 03")...)
+	return []goldenFrame{
+		{
+			name:   "ping",
+			encode: func(e *frameEncoder) { e.ping() },
+			raw:    unhex("01 18 03"),
+			frame:  Frame{Type: FramePing, Flags: 0x18},
+		},
+		{
+			name:   "pong",
+			encode: func(e *frameEncoder) { e.pong() },
+			raw:    unhex("01 10 03"),
+			frame:  Frame{Type: FramePong, Flags: 0x10},
+		},
+		{
+			name:   "ack",
+			encode: func(e *frameEncoder) { e.ack(7) },
+			raw:    unhex("01 02 00000007 03"),
+			frame:  Frame{Id: 7, Type: FrameAck, Flags: 0x02, Payload: unhex("00000007")},
+		},
+		{
+			name:   "message",
+			encode: func(e *frameEncoder) { e.data(0, 1, []byte("hi")) },
+			raw:    unhex("01 00 00000001 0002 6869 03"),
+			frame:  Frame{Id: 1, Type: FrameMessage, Payload: []byte("hi"), Segments: 1},
+		},
+		{
+			name:   "need ack",
+			encode: func(e *frameEncoder) { e.data(ctrlNeedAck, 2, []byte("hi")) },
+			raw:    unhex("01 04 00000002 0002 6869 03"),
+			frame:  Frame{Id: 2, Type: FrameMessage, Flags: 0x04, Payload: []byte("hi"), Segments: 1},
+		},
+		{
+			name:   "empty",
+			encode: func(e *frameEncoder) { e.data(0, 3, nil) },
+			raw:    unhex("01 00 00000003 0000 03"),
+			frame:  Frame{Id: 3, Type: FrameMessage, Payload: []byte{}, Segments: 1},
+		},
+		{
+			name:   "segmented",
+			encode: func(e *frameEncoder) { e.data(0, 4, segmented) },
+			raw:    segmentedRaw,
+			frame:  Frame{Id: 4, Type: FrameMessage, Flags: 0x01, Payload: segmented, Segments: 2},
+		},
+		{
+			name: "stream",
+			encode: func(e *frameEncoder) {
+				e.streamData(0, 5, streamInfo{stream: 1, priority: PriorityControl}, 0, true, []byte("hi"))
+			},
+			raw:   unhex("01 08 00000005 0001 01 0000 01 0002 6869 03"),
+			frame: Frame{Id: 5, Type: FrameMessage, Flags: 0x08, Payload: []byte("hi"), Segments: 1, Stream: 1, Priority: PriorityControl},
+		},
+		{
+			name: "checksum ping",
+			encode: func(e *frameEncoder) {
+				e.checksum = true
+				e.ping()
+			},
+			raw:   unhex("01 38 3f6b551d 03"),
+			frame: Frame{Type: FramePing, Flags: 0x38},
+		},
+		{
+			name: "checksum ack",
+			encode: func(e *frameEncoder) {
+				e.checksum = true
+				e.ack(7)
+			},
+			raw:   unhex("01 22 00000007 606ff075 03"),
+			frame: Frame{Id: 7, Type: FrameAck, Flags: 0x22, Payload: unhex("00000007")},
+		},
+		{
+			name: "checksum message",
+			encode: func(e *frameEncoder) {
+				e.checksum = true
+				e.data(ctrlNeedAck, 2, []byte("hi"))
+			},
+			raw:   unhex("01 24 00000002 b9d61452 0002 6869 03"),
+			frame: Frame{Id: 2, Type: FrameMessage, Flags: 0x24, Payload: []byte("hi"), Segments: 1},
+		},
+	}
+}
+
+func TestGoldenEncode(t *testing.T) {
+	for _, g := range goldenFrames() {
+		e := getEncoder()
+		g.encode(e)
+		e.seal()
+		if !bytes.Equal(e.buf, g.raw) {
+			t.Errorf("%s: encoded %s, want %s", g.name, abbrevHex(e.buf), abbrevHex(g.raw))
+		}
+		putEncoder(e)
+	}
+}
+
+func TestGoldenDecode(t *testing.T) {
+	for _, g := range goldenFrames() {
+		conn := newReaderConn(g.raw)
+		receiver := NewConn(&conn)
+		var f Frame
+		if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+			t.Errorf("%s: %v", g.name, err)
+			continue
+		}
+		w := g.frame
+		if f.Id != w.Id || f.Type != w.Type || f.Flags != w.Flags || f.Segments != w.Segments ||
+			f.Stream != w.Stream || f.Priority != w.Priority || !bytes.Equal(f.Payload, w.Payload) {
+			t.Errorf("%s: got id %d %v flags %#x segments %d stream %d priority %d payload %d bytes",
+				g.name, f.Id, f.Type, f.Flags, f.Segments, f.Stream, f.Priority, len(f.Payload))
+		}
+		if _, _, err := receiver.Receive(); err != io.EOF {
+			t.Errorf("%s: trailing data, err %v", g.name, err)
+		}
+	}
+}
+
+// abbrevHex 长数据包只显示开头和结尾
+func abbrevHex(b []byte) string {
+	if len(b) <= 32 {
+		return hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b[:16]) + "..." + hex.EncodeToString(b[len(b)-16:])
+}
+
+// boundarySizes 分段边界附近的消息长度
+func boundarySizes() []int {
+	sizes := []int{0, 1}
+	for k := 1; k <= 3; k++ {
+		sizes = append(sizes, k*maxSegmentLen-1, k*maxSegmentLen, k*maxSegmentLen+1)
+	}
+	return sizes
+}
+
+func TestRoundTripSegmentBoundary(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := boundarySizes()
+	// 再加入一些随机长度
+	for range 8 {
+		sizes = append(sizes, rnd.Intn(4*maxSegmentLen))
+	}
+	for _, checksum := range []bool{false, true} {
+		opts := DefaultConnOptions()
+		opts.Checksum = checksum
+		c1, c2 := net.Pipe()
+		sender, receiver := NewConnWithOptions(&c1, opts), NewConnWithOptions(&c2, opts)
+
+		messages := make([][]byte, len(sizes))
+		for i, size := range sizes {
+			messages[i] = make([]byte, size)
+			rnd.Read(messages[i])
+		}
+		go func() {
+			for _, m := range messages {
+				if err := sender.Send(m, false); err != nil {
+					return
+				}
+			}
+		}()
+		for i, m := range messages {
+			var f Frame
+			if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+				t.Fatalf("checksum %v size %d: %v", checksum, len(m), err)
+			}
+			segments := segmentCount(len(m))
+			if !bytes.Equal(f.Payload, m) || f.Id != uint32(i+1) || f.Segments != segments ||
+				(f.Flags&ctrlSeg != 0) != (segments > 1) {
+				t.Fatalf("checksum %v size %d: got id %d, %d bytes in %d segments, flags %#x",
+					checksum, len(m), f.Id, len(f.Payload), f.Segments, f.Flags)
+			}
+		}
+		sender.Close()
+		receiver.Close()
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	for _, size := range boundarySizes() {
+		e := getEncoder()
+		e.data(0, 1, make([]byte, size))
+		if len(e.buf) != frameSize(size) {
+			t.Errorf("size %d: encoded %d bytes, want %d", size, len(e.buf), frameSize(size))
+		}
+		// 每个分段的长度字段之后是数据，除最后一段外都写满
+		pos, segments := 6, segmentCount(size)
+		for i := range segments {
+			n := int(e.buf[pos])<<8 | int(e.buf[pos+1])
+			if i < segments-1 && n != maxSegmentLen {
+				t.Errorf("size %d: segment %d has %d bytes", size, i, n)
+			}
+			pos += 2 + n
+			want := dataContinue
+			if i == segments-1 {
+				want = dataEnd
+			}
+			if e.buf[pos] != want {
+				t.Errorf("size %d: segment %d terminator %#x", size, i, e.buf[pos])
+			}
+			pos++
+		}
+		putEncoder(e)
+	}
+}
+
+// fuzzLimits 模糊测试时限制内存分配
+var fuzzLimits = Limits{MaxMessageSize: 1 << 20, MaxSegments: 32}
+
+func FuzzReceive(f *testing.F) {
+	// 整段的数据包太大，最小化输入时很慢，只使用较短的种子
+	for _, g := range goldenFrames() {
+		if len(g.raw) < 64 {
+			f.Add(g.raw, false)
+		}
+	}
+	f.Add(unhex("01 01 00000001 0001 61 02 0001 62 03"), false) // 两个分段
+	f.Add(unhex("01 80 00000000 0003 04 0000 03"), false)       // CLOSE
+	f.Add(unhex("7f 01 00 00000001 0001 78 7f 01 18 03"), true)
+	f.Add(unhex("01 41 00000001 0001 00"), false)
+	f.Fuzz(func(t *testing.T, raw []byte, resync bool) {
+		opts := DefaultConnOptions()
+		opts.Limits = fuzzLimits
+		opts.Resync = resync
+		conn := newReaderConn(raw)
+		receiver := NewConnWithOptions(&conn, opts)
+		defer receiver.Close()
+		var f Frame
+		// 每个数据包至少消耗一个字节
+		for range len(raw) + 1 {
+			err := receiver.ReceiveFrame(context.Background(), &f)
+			if err != nil {
+				return
+			}
+			if len(f.Payload) > fuzzLimits.MaxMessageSize || f.Segments > fuzzLimits.MaxSegments {
+				t.Fatalf("frame exceeds limits: %d bytes in %d segments", len(f.Payload), f.Segments)
+			}
+			if f.Type == FrameCorrupted && (!resync || f.Discarded <= 0) {
+				t.Fatalf("corrupted frame with resync %v discarded %d", resync, f.Discarded)
+			}
+		}
+		t.Fatal("receive did not consume input")
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("hi"), uint32(1), false, false)
+	f.Add([]byte{}, uint32(0xffffffff), true, true)
+	f.Add([]byte{dataStart, dataContinue, dataEnd}, uint32(7), true, false)
+	f.Fuzz(func(t *testing.T, data []byte, id uint32, needAck, checksum bool) {
+		var ctrl byte
+		if needAck {
+			ctrl = ctrlNeedAck
+		}
+		e := getEncoder()
+		defer putEncoder(e)
+		e.checksum = checksum
+		e.data(ctrl, id, data)
+		e.seal()
+
+		conn := newReaderConn(e.buf)
+		receiver := NewConn(&conn)
+		var f Frame
+		if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				t.Skip()
+			}
+			t.Fatal(err)
+		}
+		if f.Type != FrameMessage || f.Id != id || !bytes.Equal(f.Payload, data) ||
+			(f.Flags&ctrlNeedAck != 0) != needAck || (f.Flags&ctrlChecksum != 0) != checksum {
+			t.Fatalf("got id %d %v flags %#x payload %d bytes", f.Id, f.Type, f.Flags, len(f.Payload))
+		}
+	})
+}
@@ -1,11 +1,13 @@
 package dstp
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,10 +18,18 @@ import (
 Distributed Simulation Transport Protocol (DSTP)
 数据包格式：
 |开始标记|控制标记|消息id|数据长度|数据|继续标识|数据长度|数据|结束标记|
-控制标记:1字节，|0|0|0|是否为ping包|ping包0为pong1为ping|是否需要应答ack|是否为ack包0否1是|是否分段|
+控制标记:1字节，|是否为扩展包|是否压缩|是否带校验和|是否为ping包|ping包0为pong1为ping|是否需要应答ack|是否为ack包0否1是|是否分段|
 ping包: |0x01|00010000|0x03| pong包: |0x01|00011000|0x03|
 ack包: |0x01|00000010|应答消息id|0x03|
 需要应答的分段的数据包: |0x01|00000101|消息id|数据长度|数据|继续标识|数据长度|数据|0x03|
+带校验和的数据包在消息id(ping/pong 包在控制标记)之后加 4 字节 CRC32C，
+覆盖开始标记之后除校验和以外的所有字节: |0x01|00100000|消息id|校验和|数据长度|数据|0x03|
+压缩的数据包数据的第一个字节为压缩算法编号，后面是压缩后的数据，分段按压缩后的长度计算
+非 ping 包的 ping 标记位表示带流头，流头在消息id(和校验和)之后: |流id(2)|优先级(1)|分块序号(2)|标记(1)|
+对方支持流时大消息拆成多个带流头的分块，每个分块是一个完整的数据包，不同流的分块可以交错
+扩展包(握手等)与普通数据包格式相同，消息id为 0，数据的第一个字节为扩展类型: |0x01|10000000|0|数据长度|扩展类型|数据|0x03|
+握手完成的连接关闭时发送 CLOSE 扩展包，对方回复 CLOSE 后断开，Receive 返回 io.EOF
+启用流量控制后接收方用 WINDOW 扩展包通告允许的最大消息id，发送方超出后等待
 */
 
 const (
@@ -27,353 +37,714 @@ const (
 	dataContinue byte = 0x02
 	dataEnd      byte = 0x03
 
-	ctrlSeg     byte = 0b00000001
-	ctrlIfPing  byte = 0b00010000
-	ctrlPing    byte = 0b00001000
-	ctrlNeedAck byte = 0b00000100
-	ctrlIfAck   byte = 0b00000010
+	ctrlSeg      byte = 0b00000001
+	ctrlChecksum byte = 0b00100000
+	ctrlCompress byte = 0b01000000
+	ctrlExt      byte = 0b10000000
+	ctrlIfPing   byte = 0b00010000
+	ctrlPing     byte = 0b00001000
+	ctrlStream   byte = 0b00001000 // 与 ctrlPing 同一位，只用于非 ping 包
+	ctrlNeedAck  byte = 0b00000100
+	ctrlIfAck    byte = 0b00000010
 )
 
+// 关闭连接时写出 CLOSE 的最长等待时间
+const closeWriteTimeout = 100 * time.Millisecond
+
 type Conn struct {
-	conn   *net.Conn
-	closed atomic.Bool
-	ackMap sync.Map
-	mtx    sync.Mutex
+	conn          *net.Conn
+	opts          ConnOptions
+	dec           *frameDecoder
+	closed        atomic.Bool
+	writeMtx      writeLock     // 写锁，按优先级排队，等待时响应 ctx
+	nextId        atomic.Uint32 // 最近分配的消息id，每个连接从 1 开始递增，溢出后回绕
+	recvSeq       seqTracker
+	pending       map[uint32]*pendingAck // 等待应答的消息 key: 消息id
+	pendingMtx    sync.Mutex
+	rtt           rttEstimator
+	ackLatency    latencyEstimator
+	traffic       traffic
+	readDeadline  *connDeadline
+	writeDeadline *connDeadline
+	done          chan struct{} // 连接关闭时关闭
+	closeErr      atomic.Pointer[error]
+
+	corruptedFrames atomic.Uint64
+	discardedBytes  atomic.Uint64
+	checksumErrors  atomic.Uint64
+
+	checksum atomic.Bool // 发送的数据包是否带校验和，握手后按协商结果设置
+	features atomic.Pointer[Features]
+	zbuf     []byte // 解压时暂存压缩数据，只在接收协程中使用
+
+	sendWin sendWindow
+	recvWin recvWindow
+
+	closing   atomic.Bool // Shutdown 开始后不再接受新的消息
+	closeSent atomic.Bool
+	peerClose atomic.Pointer[closeInfo]
+	drained   chan struct{} // 等待应答的消息全部结束时关闭，由 pendingMtx 保护
+
+	streamMtx   sync.Mutex
+	streamLocks map[uint16]chan struct{}   // 每个流的发送锁
+	credits     map[uint16]*streamCredit   // 对方给出的分块信用
+	partials    map[uint16]*partialMessage // 正在拼接的分块消息，只在接收协程中使用
+	inbound     map[uint16]*inboundStream  // 正在按流接收的消息，只在接收协程中使用
 }
 
-func (c *Conn) sendData(data []byte, needAck bool, waitAck bool, ackMessageId uint32) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	if c.closed.Load() {
-		return io.ErrClosedPipe
+// 发送一条新消息，需要应答时按重传策略等待应答
+func (c *Conn) sendData(ctx context.Context, data []byte, opts SendOptions) (uint32, error) {
+	if c.closing.Load() {
+		return 0, ErrClosed
 	}
-
-	needSegment := false
-	segment := 1
-
-	if len(data)/((1<<16)-1) != 0 {
-		segment = len(data) / ((1 << 16) - 1)
-		if len(data)%((1<<16)-1) != 0 {
-			segment++
-		}
+	if f := c.features.Load(); f != nil && f.MaxMessageSize > 0 && len(data) > f.MaxMessageSize {
+		return 0, fmt.Errorf("%w: peer accepts at most %d bytes", ErrFrameTooLarge, f.MaxMessageSize)
 	}
 
-	if segment > 1 {
-		needSegment = true
+	var controlData byte
+	if opts.NeedAck {
+		controlData |= ctrlNeedAck
 	}
-
-	_, err := (*c.conn).Write([]byte{dataStart})
+	payload, compressed, err := c.compressPayload(data)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if compressed {
+		controlData |= ctrlCompress
 	}
 
-	var controlData byte
-	controlData = 0b00000000
+	// 对方支持流时同一个流上的消息依次发送，不需要流头的消息不拆分
+	var s *streamInfo
+	if c.peerHas(CapStreams) {
+		if opts.Stream != 0 || opts.Priority != PriorityNormal || len(payload) > streamPartSize {
+			s = &streamInfo{stream: opts.Stream, priority: opts.Priority}
+		}
+		unlock, err := c.lockStream(ctx, opts.Stream)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
 
-	if needAck {
-		controlData |= 0b00000100
+	var p *pendingAck
+	if opts.NeedAck {
+		p = newPendingAck(controlData, payload, s, opts.Priority, c.retryPolicy(opts), opts.OnResult)
 	}
-	if needSegment {
-		controlData |= 0b00000001
+
+	e := c.encodePart(controlData, 0, payload, s, 0)
+	messageId, err := c.writeData(ctx, e, p, opts.Priority, opts.NonBlocking)
+	putEncoder(e)
+	if err == nil {
+		err = c.writeParts(ctx, controlData, messageId, payload, s, opts.Priority, 1)
+		if err != nil && p != nil {
+			c.dropPending(messageId)
+		}
 	}
-	_, err = (*c.conn).Write([]byte{controlData})
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	var messageId uint32
-
-	if waitAck {
-		messageId = ackMessageId
-	} else {
-		messageId = uint32(time.Now().UnixNano() + rand.Int63())
+	if p != nil {
+		go c.retransmit(messageId, p)
 	}
-	messageIdBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(messageIdBuf, messageId)
-	_, err = (*c.conn).Write(messageIdBuf)
-	if err != nil {
-		return err
+	return messageId, nil
+}
+
+// encodePart 编码消息的一个分块，s 为 nil 时整条消息编码成一个数据包
+func (c *Conn) encodePart(ctrl byte, messageId uint32, payload []byte, s *streamInfo, part int) *frameEncoder {
+	e := c.encoder()
+	if s == nil {
+		e.data(ctrl, messageId, payload)
+		return e
 	}
+	count := partCount(len(payload), s)
+	start := part * streamPartSize
+	end := min(start+streamPartSize, len(payload))
+	e.streamData(ctrl, messageId, *s, uint16(part), part == count-1, payload[start:end])
+	return e
+}
 
-	if segment <= 1 {
-		dataLen := len(data)
-		dataLenBuf := make([]byte, 2)
-		binary.BigEndian.PutUint16(dataLenBuf, uint16(dataLen))
-		_, err = (*c.conn).Write(dataLenBuf)
+// writeParts 从 from 开始依次写出消息的分块，每个分块单独获取写锁
+func (c *Conn) writeParts(ctx context.Context, ctrl byte, messageId uint32, payload []byte, s *streamInfo, priority Priority, from int) error {
+	for part := from; part < partCount(len(payload), s); part++ {
+		e := c.encodePart(ctrl, messageId, payload, s, part)
+		err := c.writeFrame(ctx, e, priority)
+		putEncoder(e)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		_, err = (*c.conn).Write(data)
+// resendData 重传需要应答的消息，沿用原来的消息id、控制标记和流
+func (c *Conn) resendData(p *pendingAck, messageId uint32) error {
+	ctx := context.Background()
+	if p.stream != nil {
+		unlock, err := c.lockStream(ctx, p.stream.stream)
 		if err != nil {
 			return err
 		}
+		defer unlock()
+	}
+	return c.writeParts(ctx, p.ctrl, messageId, p.data, p.stream, p.priority, 0)
+}
 
-		_, err = (*c.conn).Write([]byte{dataEnd})
-		if err != nil {
-			return err
-		}
-	} else {
-		for i := 0; i < segment; i++ {
-			if i == segment-1 {
-				dataLen := len(data) - i*((1<<16)-1)
-				dataLenBuf := make([]byte, 2)
-				binary.BigEndian.PutUint16(dataLenBuf, uint16(dataLen))
-				_, err = (*c.conn).Write(dataLenBuf)
-				_, err = (*c.conn).Write(data[i*((1<<16)-1) : i*((1<<16)-1)+dataLen])
-				if err != nil {
-					return err
-				}
-			} else {
-				dataLen := ((1 << 16) - 1)
-				dataLenBuf := make([]byte, 2)
-				binary.BigEndian.PutUint16(dataLenBuf, uint16(dataLen))
-				_, err = (*c.conn).Write(dataLenBuf)
-				if err != nil {
-					return err
-				}
-				_, err = (*c.conn).Write(data[i*((1<<16)-1) : (i+1)*((1<<16)-1)])
-				if err != nil {
-					return err
-				}
-			}
+// peerHas 判断握手是否协商出了 capability
+func (c *Conn) peerHas(capability Capabilities) bool {
+	f := c.features.Load()
+	return f != nil && f.Capabilities.Has(capability)
+}
 
-			if i == segment-1 {
-				_, err = (*c.conn).Write([]byte{dataEnd})
-				if err != nil {
-					return err
-				}
-			} else {
-				_, err = (*c.conn).Write([]byte{dataContinue})
-				if err != nil {
-					return err
-				}
-			}
-		}
-	}
+// encoder 取出编码器，按连接选项或握手结果决定是否带校验和
+func (c *Conn) encoder() *frameEncoder {
+	e := getEncoder()
+	e.checksum = c.checksum.Load()
+	return e
+}
 
-	if needAck && !waitAck {
-		go func() {
-			for i := 0; i < 3; i++ {
-				time.Sleep(10 * time.Second)
-				if _, ok := c.ackMap.Load(messageId); ok {
-					c.ackMap.Delete(messageId)
-					break
-				} else {
-					c.sendData(data, true, true, messageId)
-				}
-			}
-		}()
+// lockWrite 按优先级获取写锁，等待期间 ctx 结束则放弃
+func (c *Conn) lockWrite(ctx context.Context, priority Priority) error {
+	if err := c.writeMtx.lock(ctx, priority); err != nil {
+		return err
+	}
+	if c.closed.Load() {
+		c.writeMtx.unlock()
+		return ErrClosed
 	}
 	return nil
 }
 
-func (c *Conn) sendAck(messageId uint32) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	if c.closed.Load() {
-		return io.ErrClosedPipe
-	}
+func (c *Conn) unlockWrite() {
+	c.writeMtx.unlock()
+}
 
-	_, err := (*c.conn).Write([]byte{dataStart})
-	if err != nil {
-		return err
+// write 在持有写锁时写出编码好的数据包，ctx 结束会中断写入
+func (c *Conn) write(ctx context.Context, e *frameEncoder) error {
+	e.seal()
+	restore := c.writeDeadline.watch(ctx)
+	n, err := (*c.conn).Write(e.buf)
+	restore()
+	if err == nil {
+		c.onFrameSent(e)
 	}
-	_, err = (*c.conn).Write([]byte{ctrlIfAck})
-	if err != nil {
-		return err
-	}
-	messageIdBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(messageIdBuf, messageId)
-	_, err = (*c.conn).Write(messageIdBuf)
-	if err != nil {
-		return err
+	if ctxErr := contextError(ctx, err); ctxErr != nil {
+		if n > 0 {
+			// 数据包只写出了一部分，对方无法再找到数据包边界
+			go c.Close()
+		}
+		return ctxErr
 	}
-	_, err = (*c.conn).Write([]byte{dataEnd})
 	return err
 }
 
-func (c *Conn) sendPing() error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	if c.closed.Load() {
-		return io.ErrClosedPipe
+// writeFrame 在锁内一次性写出编码好的数据包，避免并发发送时数据包交错
+func (c *Conn) writeFrame(ctx context.Context, e *frameEncoder, priority Priority) error {
+	if err := c.lockWrite(ctx, priority); err != nil {
+		return err
 	}
+	defer c.unlockWrite()
+	return c.write(ctx, e)
+}
 
-	_, err := (*c.conn).Write([]byte{dataStart})
-	if err != nil {
-		return err
+// writeData 在锁内分配下一个消息id并写出第一个分块，保证线路上消息的第一个数据包的id单调递增
+// p 不为 nil 时在写出前登记等待应答，避免应答先于登记到达
+// 在获取写锁之前等待对方的窗口，等待期间 ack 和 pong 仍然可以写出
+func (c *Conn) writeData(ctx context.Context, e *frameEncoder, p *pendingAck, priority Priority, nonBlocking bool) (uint32, error) {
+	var messageId uint32
+	for {
+		if err := c.waitWindow(ctx, nonBlocking); err != nil {
+			return 0, err
+		}
+		if err := c.lockWrite(ctx, priority); err != nil {
+			return 0, err
+		}
+		messageId = c.nextId.Load() + 1
+		if c.sendWin.allows(messageId) {
+			break
+		}
+		// 窗口被并发的发送用完，重新等待
+		c.unlockWrite()
 	}
-	ctrlData := ctrlIfPing | ctrlPing
-	_, err = (*c.conn).Write([]byte{ctrlData})
-	if err != nil {
-		return err
+	defer c.unlockWrite()
+	c.nextId.Store(messageId)
+	e.setId(messageId)
+	if p != nil {
+		p.sentAt = time.Now()
+		c.pendingMtx.Lock()
+		c.pending[messageId] = p
+		c.pendingMtx.Unlock()
 	}
-	_, err = (*c.conn).Write([]byte{dataEnd})
-	return err
+	err := c.write(ctx, e)
+	if err != nil && p != nil {
+		c.dropPending(messageId)
+	}
+	return messageId, err
+}
+
+func (c *Conn) sendAck(messageId uint32) error {
+	e := c.encoder()
+	defer putEncoder(e)
+	e.ack(messageId)
+	return c.writeFrame(context.Background(), e, priorityInternal)
+}
+
+// sendPing 写出 ping，没有写出时这个 ping 同样等待 pong，由 keepalive 计入未收到 pong 的周期
+func (c *Conn) sendPing(ctx context.Context) error {
+	c.rtt.onPing(time.Now())
+	e := c.encoder()
+	defer putEncoder(e)
+	e.ping()
+	return c.writeFrame(ctx, e, priorityInternal)
 }
 
 func (c *Conn) sendPong() error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	if c.closed.Load() {
-		return io.ErrClosedPipe
+	e := c.encoder()
+	defer putEncoder(e)
+	e.pong()
+	return c.writeFrame(context.Background(), e, priorityInternal)
+}
+
+// receiveFrame 接收一个数据包，数据追加到 f.Payload[:0] 中
+// ping 包自动回复 pong，ack 包结束对应消息的等待
+// 重传导致的重复消息只应答不交付
+func (c *Conn) receiveFrame(f *Frame) error {
+	buf := f.Payload
+
+	for {
+		*f = Frame{Payload: buf[:0]}
+
+		if err := c.readFrame(f); err != nil {
+			if errors.Is(err, ErrChecksum) {
+				// 数据包边界完好，丢弃这个数据包后连接仍然可用
+				// 需要应答的消息不应答，由发送方重传
+				c.checksumErrors.Add(1)
+				if c.opts.Resync {
+					*f = Frame{Type: FrameCorrupted, Payload: f.Payload[:0], Discarded: c.dec.consumed}
+					c.corruptedFrames.Add(1)
+					c.discardedBytes.Add(uint64(f.Discarded))
+					return nil
+				}
+				return err
+			}
+			if c.opts.Resync && isCorrupted(err) {
+				return c.skipCorrupted(f, err)
+			}
+			return err
+		}
+		c.onFrameReceived(f)
+
+		switch f.Type {
+		case FramePing:
+			return c.sendPong()
+		case FramePong:
+			c.rtt.onPong(time.Now())
+			return nil
+		case FrameAck:
+			f.Payload = binary.BigEndian.AppendUint32(f.Payload, f.Id)
+			c.resolvePending(f.Id, nil)
+			return nil
+		case frameExt:
+			return c.handleExt(f)
+		}
+
+		if c.streamed(f) {
+			deliver, err := c.receivePart(f)
+			if err != nil || deliver {
+				return err
+			}
+			buf = f.Payload
+			continue
+		}
+		fresh := false
+		if f.Flags&ctrlStream == ctrlStream {
+			complete, ok, err := c.assemble(f)
+			if err != nil {
+				return err
+			}
+			if !complete {
+				buf = f.Payload
+				continue
+			}
+			fresh = ok
+		}
+
+		duplicate := false
+		if fresh {
+			c.recvSeq.record(f.Id)
+		} else {
+			duplicate = c.recvSeq.observe(f.Id)
+		}
+		if f.Flags&ctrlNeedAck == ctrlNeedAck {
+			// 重复的消息同样需要应答，否则发送方会继续重传
+			if err := c.sendAck(f.Id); err != nil {
+				return err
+			}
+		}
+		if duplicate {
+			buf = f.Payload
+			continue
+		}
+		if err := c.advertiseWindow(false); err != nil {
+			return err
+		}
+		if f.Flags&ctrlCompress == ctrlCompress {
+			return c.decompressPayload(f)
+		}
+		return nil
 	}
+}
 
-	_, err := (*c.conn).Write([]byte{dataStart})
+// readFrame 读取一个完整的数据包，不做任何处理
+func (c *Conn) readFrame(f *Frame) error {
+	start, err := c.dec.readStart()
 	if err != nil {
 		return err
 	}
-	ctrlData := ctrlIfPing
-	_, err = (*c.conn).Write([]byte{ctrlData})
-	if err != nil {
-		return err
+	if start != dataStart {
+		return fmt.Errorf("%w: 0x%02x", ErrBadStartByte, start)
+	}
+
+	err = c.withHeaderTimeout(func() error {
+		return c.readHeader(f)
+	})
+	if err == nil && (f.Type == FrameMessage || f.Type == frameExt) {
+		err = c.readSegments(f)
+	}
+	if err == nil && !c.dec.checksumOk() {
+		err = fmt.Errorf("%w: message %d", ErrChecksum, f.Id)
 	}
-	_, err = (*c.conn).Write([]byte{dataEnd})
 	return err
 }
 
-// 接收数据包 return 数据
-// 数据类型int
-// 1 普通消息
-// 2 ping包
-// 3 pong包
-// 4 ack应答
-func (c *Conn) receiveData() ([]byte, int, error) {
-	var data []byte
+// isCorrupted 判断是否为数据包边界错误，恢复模式下可以跳过
+func isCorrupted(err error) bool {
+	return errors.Is(err, ErrBadStartByte) || errors.Is(err, ErrBadTerminator)
+}
 
-	startBuf := make([]byte, 1)
-	_, err := io.ReadFull((*c.conn), startBuf)
+// skipCorrupted 丢弃损坏的数据直到下一个开始标记，f 作为 FrameCorrupted 返回
+func (c *Conn) skipCorrupted(f *Frame, err error) error {
+	discarded, err := c.dec.resync(err)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
+	*f = Frame{Type: FrameCorrupted, Payload: f.Payload[:0], Discarded: discarded}
+	c.corruptedFrames.Add(1)
+	c.discardedBytes.Add(uint64(discarded))
+	return nil
+}
 
-	if startBuf[0] != dataStart {
-		return nil, 0, fmt.Errorf("invalid data start")
-	}
+// readHeader 读取开始标记之后的头部：控制标记和消息id
+// ping、pong、ack 包没有数据，连同结束标记一起读完
+func (c *Conn) readHeader(f *Frame) error {
+	d := c.dec
 
-	ctrlBuf := make([]byte, 1)
-	_, err = io.ReadFull((*c.conn), ctrlBuf)
+	ctrlData, err := d.readByte()
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+	f.Flags = ctrlData
+	checksum := ctrlData&ctrlChecksum == ctrlChecksum
+	if checksum {
+		d.beginChecksum(ctrlData)
 	}
-
-	ctrlData := ctrlBuf[0]
 
 	if ctrlData&ctrlIfPing == ctrlIfPing {
 		if ctrlData&ctrlPing == ctrlPing {
-			err := c.sendPong()
-			if err != nil {
-				return nil, 2, err
-			}
-			endBuf := make([]byte, 1)
-			_, err = io.ReadFull((*c.conn), endBuf)
-			return nil, 2, err
+			f.Type = FramePing
 		} else {
-			endBuf := make([]byte, 1)
-			_, err = io.ReadFull((*c.conn), endBuf)
-			return nil, 3, err
+			f.Type = FramePong
+		}
+		if checksum {
+			if err := d.readChecksum(); err != nil {
+				return err
+			}
 		}
+		return d.readEnd()
 	}
 
-	messageIdBuf := make([]byte, 4)
-	if ctrlData&ctrlIfAck == ctrlIfAck {
-		_, err = io.ReadFull((*c.conn), messageIdBuf)
-		if err != nil {
-			return nil, 4, err
+	f.Id, err = d.readUint32()
+	if err != nil {
+		return err
+	}
+	if checksum {
+		if err := d.readChecksum(); err != nil {
+			return err
 		}
-		messageId := binary.BigEndian.Uint32(messageIdBuf)
-		endBuf := make([]byte, 1)
-		_, err = io.ReadFull((*c.conn), endBuf)
-		c.ackMap.Store(messageId, struct{}{})
-		return messageIdBuf, 4, err
 	}
 
-	needAck := ctrlData&ctrlNeedAck == ctrlNeedAck
-	_, err = io.ReadFull((*c.conn), messageIdBuf)
+	if ctrlData&ctrlExt == ctrlExt {
+		f.Type = frameExt
+		return nil
+	}
+	if ctrlData&ctrlIfAck == ctrlIfAck {
+		f.Type = FrameAck
+		return d.readEnd()
+	}
+	f.Type = FrameMessage
+	if ctrlData&ctrlStream == ctrlStream {
+		return c.readStreamHeader(f)
+	}
+	return nil
+}
+
+// readStreamHeader 读取消息id之后的流头
+func (c *Conn) readStreamHeader(f *Frame) error {
+	d := c.dec
+	stream, err := d.readUint16()
+	if err != nil {
+		return err
+	}
+	priority, err := d.readByte()
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+	part, err := d.readUint16()
+	if err != nil {
+		return err
+	}
+	flags, err := d.readByte()
+	if err != nil {
+		return err
 	}
-	messageId := binary.BigEndian.Uint32(messageIdBuf)
-	needSegment := ctrlData&ctrlSeg == ctrlSeg
+	f.Stream = stream
+	f.Priority = Priority(int8(priority))
+	f.part = part
+	f.last = flags&streamLastPart == streamLastPart
+	f.aborted = flags&streamAborted == streamAborted
+	return nil
+}
+
+// readSegments 读取各分段数据和结束标记
+func (c *Conn) readSegments(f *Frame) error {
+	d := c.dec
+	limits := c.opts.Limits
 
 	for {
-		if needSegment {
-			dataLenBuf := make([]byte, 2)
-			_, err := io.ReadFull((*c.conn), dataLenBuf)
-			if err != nil {
-				return nil, 1, err
-			}
-			dataLen := binary.BigEndian.Uint16(dataLenBuf)
-			dataT := make([]byte, dataLen)
-			_, err = io.ReadFull((*c.conn), dataT)
-			if err != nil {
-				return nil, 1, err
-			}
-			data = append(data, dataT...)
-		} else {
-			dataLenBuf := make([]byte, 2)
-			_, err := io.ReadFull((*c.conn), dataLenBuf)
-			if err != nil {
-				return nil, 1, err
-			}
-			dataLen := binary.BigEndian.Uint16(dataLenBuf)
-			data = make([]byte, dataLen)
-			_, err = io.ReadFull((*c.conn), data)
-			if err != nil {
-				return nil, 1, err
-			}
+		dataLen, err := d.readUint16()
+		if err != nil {
+			return err
+		}
+		if limits.MaxMessageSize > 0 && len(f.Payload)+int(dataLen) > limits.MaxMessageSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, limits.MaxMessageSize)
 		}
-		buf := make([]byte, 1)
-		_, err := io.ReadFull((*c.conn), buf)
+		f.Payload, err = d.readPayload(f.Payload, int(dataLen))
 		if err != nil {
-			return nil, 1, err
+			return err
 		}
-		if buf[0] == dataEnd {
-			if needAck {
-				err := c.sendAck(messageId)
-				if err != nil {
-					return nil, 1, err
-				}
+		f.Segments++
+		end, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch end {
+		case dataEnd:
+			return nil
+		case dataContinue:
+			if limits.MaxSegments > 0 && f.Segments >= limits.MaxSegments {
+				return fmt.Errorf("%w: more than %d segments", ErrTooManySegments, limits.MaxSegments)
 			}
-			return data, 1, nil
-		} else if buf[0] == dataContinue {
 			continue
-		} else if buf[0] == dataStart {
-			return nil, 1, fmt.Errorf("invalid data start")
-		} else {
-			return nil, 1, fmt.Errorf("invalid data end")
+		default:
+			return fmt.Errorf("%w: 0x%02x", ErrBadTerminator, end)
+		}
+	}
+}
+
+// withHeaderTimeout 在 Limits.HeaderTimeout 内完成 read，超时返回 ErrHeaderTimeout
+func (c *Conn) withHeaderTimeout(read func() error) error {
+	timeout := c.opts.Limits.HeaderTimeout
+	if timeout <= 0 {
+		return read()
+	}
+	c.readDeadline.setTimeout(time.Now().Add(timeout))
+	err := read()
+	c.readDeadline.setTimeout(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) && !c.readDeadline.ctxExpired() {
+		return ErrHeaderTimeout
+	}
+	return err
+}
+
+// receiveFrameContext 在 ctx 的控制下接收数据包，见 ReceiveContext
+// 扩展包在内部处理，不返回给调用方
+func (c *Conn) receiveFrameContext(ctx context.Context, f *Frame) error {
+	for {
+		err := c.receiveContext(ctx, f)
+		if err != nil || f.Type != frameExt {
+			return err
 		}
 	}
 }
 
+// receiveContext 在 ctx 的控制下接收一个数据包，包括扩展包
+func (c *Conn) receiveContext(ctx context.Context, f *Frame) error {
+	restore := c.readDeadline.watch(ctx)
+	err := c.receiveFrame(f)
+	restore()
+	if ctxErr := contextError(ctx, err); ctxErr != nil {
+		if c.dec.partial {
+			c.Close()
+		}
+		return ctxErr
+	}
+	if errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrTooManySegments) || errors.Is(err, ErrHeaderTimeout) {
+		// 超过限制的数据包没有读完，无法继续解析后面的数据
+		c.closeWith(CloseProtocolError, nil)
+		return err
+	}
+	if errors.Is(err, ErrIncompatiblePeer) || errors.Is(err, ErrHandshake) {
+		c.closeWithError(err)
+		return err
+	}
+	if err == io.EOF && c.closing.Load() {
+		// Shutdown 期间对方没有回复 CLOSE 就断开了
+		c.closeWithError(err)
+	}
+	if err != nil && c.closed.Load() {
+		if closeErr := c.closeErr.Load(); closeErr != nil {
+			return *closeErr
+		}
+	}
+	return err
+}
+
 func (c *Conn) Send(data []byte, needAck bool) error {
-	return c.sendData(data, needAck, false, 0)
+	_, err := c.sendData(context.Background(), data, SendOptions{NeedAck: needAck})
+	return err
+}
+
+// SendContext 与 Send 相同，ctx 结束时中断等待和写入并返回 ctx.Err()
+// 数据包只写出一部分时连接会被关闭
+func (c *Conn) SendContext(ctx context.Context, data []byte, needAck bool) error {
+	_, err := c.sendData(ctx, data, SendOptions{NeedAck: needAck})
+	return err
+}
+
+// SendMessage 与 Send 相同，返回为该消息分配的id，用于关联应答和重传
+func (c *Conn) SendMessage(data []byte, needAck bool) (uint32, error) {
+	return c.sendData(context.Background(), data, SendOptions{NeedAck: needAck})
+}
+
+// SendWithOptions 按指定选项发送消息，返回为该消息分配的id
+// 需要应答时，在收到应答前不要修改 data，重传会再次发送它
+func (c *Conn) SendWithOptions(data []byte, opts SendOptions) (uint32, error) {
+	return c.sendData(context.Background(), data, opts)
+}
+
+// SendAndWait 发送需要应答的消息并等待应答
+// 对方一直没有应答时返回 ErrAckTimeout，ctx 结束时停止重传并返回 ctx.Err()
+// 应答由 Receive 处理，调用期间需要有其他协程在接收数据
+func (c *Conn) SendAndWait(ctx context.Context, data []byte) error {
+	return c.SendAndWaitWithOptions(ctx, data, SendOptions{})
+}
+
+// SendAndWaitWithOptions 与 SendAndWait 相同，按 opts 选择重传策略、流和优先级
+// opts 的 NeedAck 和 OnResult 不生效
+func (c *Conn) SendAndWaitWithOptions(ctx context.Context, data []byte, opts SendOptions) error {
+	result := make(chan error, 1)
+	opts.NeedAck = true
+	opts.OnResult = func(_ uint32, err error) {
+		result <- err
+	}
+	messageId, err := c.sendData(ctx, data, opts)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		c.resolvePending(messageId, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// LastSentId 返回最近一次分配的消息id
+func (c *Conn) LastSentId() uint32 {
+	return c.nextId.Load()
+}
+
+// LastReceivedId 返回已接收的最大消息id
+func (c *Conn) LastReceivedId() uint32 {
+	last, _, _ := c.recvSeq.snapshot()
+	return last
+}
+
+// SeqGaps 返回接收时检测到的消息id空缺数和重复数
+func (c *Conn) SeqGaps() (gaps, duplicates uint64) {
+	_, gaps, duplicates = c.recvSeq.snapshot()
+	return
 }
 
 func (c *Conn) Ping() error {
-	return c.sendPing()
+	return c.sendPing(context.Background())
 }
 
 func (c *Conn) Pong() error {
 	return c.sendPong()
 }
 
-// 接收数据包 return 数据
-// 数据类型int
-// 1 普通消息
-// 2 ping包
-// 3 pong包
-// 4 ack应答
-func (c *Conn) Receive() (data []byte, type_ int, err error) {
-	data, type_, err = c.receiveData()
-	return
+// 接收数据包 return 数据 和数据包类型
+// ack 包的数据为被应答的消息id(4字节大端)
+func (c *Conn) Receive() (data []byte, type_ FrameType, err error) {
+	return c.ReceiveIntoContext(context.Background(), nil)
+}
+
+// ReceiveInto 与 Receive 相同，但数据写入调用方提供的 buf 中以复用内存
+// 返回的数据在下一次调用前有效
+func (c *Conn) ReceiveInto(buf []byte) (data []byte, type_ FrameType, err error) {
+	return c.ReceiveIntoContext(context.Background(), buf)
+}
+
+// ReceiveContext 与 Receive 相同，ctx 结束或到达截止时间时返回 ctx.Err()
+// 在读取数据包中途被中断时连接会被关闭
+func (c *Conn) ReceiveContext(ctx context.Context) (data []byte, type_ FrameType, err error) {
+	return c.ReceiveIntoContext(ctx, nil)
+}
+
+// ReceiveIntoContext 与 ReceiveInto 相同，ctx 的行为见 ReceiveContext
+func (c *Conn) ReceiveIntoContext(ctx context.Context, buf []byte) (data []byte, type_ FrameType, err error) {
+	f := Frame{Payload: buf}
+	err = c.receiveFrameContext(ctx, &f)
+	if err != nil {
+		return nil, f.Type, err
+	}
+	return f.Payload, f.Type, nil
+}
+
+// ReceiveFrame 接收一个数据包到 f 中，f.Payload 的容量会被复用
+// ctx 的行为见 ReceiveContext
+func (c *Conn) ReceiveFrame(ctx context.Context, f *Frame) error {
+	return c.receiveFrameContext(ctx, f)
 }
 
+// Close 立即关闭连接，握手完成时先尽量发出 CLOSE，需要等待消息送达时使用 Shutdown
 func (c *Conn) Close() {
+	c.closeWith(CloseGoingAway, nil)
+}
+
+// closeWithError 关闭连接，之后的 Receive 返回 err
+func (c *Conn) closeWithError(err error) {
+	code := CloseGoingAway
+	if errors.Is(err, ErrHandshake) || errors.Is(err, ErrIncompatiblePeer) {
+		code = CloseProtocolError
+	}
+	c.closeWith(code, err)
+}
+
+// closeWith 关闭连接并以 code 通知对方，err 不为 nil 时之后的 Receive 返回 err
+func (c *Conn) closeWith(code CloseCode, err error) {
+	if err != nil {
+		c.closeErr.CompareAndSwap(nil, &err)
+	}
 	if c.closed.CompareAndSwap(false, true) {
-		(*c.conn).Write([]byte{dataEnd})
+		close(c.done)
+		// 对方不再读取时写入会一直阻塞，只等待很短的时间
+		ctx, cancel := context.WithTimeout(context.Background(), closeWriteTimeout)
+		c.sendClose(ctx, code, "")
+		cancel()
 		(*c.conn).Close()
+		c.failPending(ErrClosed)
 	}
 }
 
@@ -386,10 +757,28 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 func NewConn(conn *net.Conn) *Conn {
-	return &Conn{
-		conn:   conn,
-		closed: atomic.Bool{},
-		ackMap: sync.Map{},
-		mtx:    sync.Mutex{},
+	return NewConnWithOptions(conn, DefaultConnOptions())
+}
+
+func NewConnWithOptions(conn *net.Conn, opts ConnOptions) *Conn {
+	c := &Conn{
+		conn:    conn,
+		opts:    opts,
+		dec:     newFrameDecoder(*conn),
+		closed:  atomic.Bool{},
+		pending: make(map[uint32]*pendingAck),
+		done:    make(chan struct{}),
+
+		streamLocks: make(map[uint16]chan struct{}),
+		credits:     make(map[uint16]*streamCredit),
+		partials:    make(map[uint16]*partialMessage),
+		inbound:     make(map[uint16]*inboundStream),
+	}
+	c.checksum.Store(opts.Checksum)
+	c.readDeadline = newConnDeadline((*conn).SetReadDeadline)
+	c.writeDeadline = newConnDeadline((*conn).SetWriteDeadline)
+	if opts.Keepalive.Interval > 0 {
+		go c.keepalive(opts.Keepalive)
 	}
+	return c
 }
@@ -0,0 +1,458 @@
+package dstp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeqLess(t *testing.T) {
+	cases := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{0xFFFFFFFF, 0, true},
+		{0xFFFFFFF0, 5, true},
+		{5, 0xFFFFFFF0, false},
+	}
+	for _, c := range cases {
+		if got := SeqLess(c.a, c.b); got != c.less {
+			t.Errorf("SeqLess(%#x, %#x) = %v, want %v", c.a, c.b, got, c.less)
+		}
+	}
+}
+
+func TestSeqTracker(t *testing.T) {
+	var s seqTracker
+	for _, id := range []uint32{0xFFFFFFFE, 0xFFFFFFFF, 0, 3} {
+		if s.observe(id) {
+			t.Fatalf("%#x reported as duplicate", id)
+		}
+	}
+	if !s.observe(0xFFFFFFFF) {
+		t.Fatal("old id not reported as duplicate")
+	}
+	last, gaps, dups := s.snapshot()
+	if last != 3 || gaps != 2 || dups != 1 {
+		t.Fatalf("last %d gaps %d dups %d, want 3 2 1", last, gaps, dups)
+	}
+}
+
+func TestMessageIdsMonotonic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	const n = 200
+	ids := make(chan uint32, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := sender.SendMessage([]byte("hello"), false)
+			if err != nil {
+				t.Error(err)
+			}
+			ids <- id
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if _, _, err := receiver.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint32]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d assigned twice", id)
+		}
+		seen[id] = true
+	}
+	if sender.LastSentId() != n || receiver.LastReceivedId() != n {
+		t.Fatalf("last sent %d, last received %d, want %d", sender.LastSentId(), receiver.LastReceivedId(), n)
+	}
+	if gaps, dups := receiver.SeqGaps(); gaps != 0 || dups != 0 {
+		t.Fatalf("gaps %d dups %d on an in-order stream", gaps, dups)
+	}
+}
+
+func TestSeqTrackerLateArrival(t *testing.T) {
+	var s seqTracker
+	for _, id := range []uint32{1, 2, 5} {
+		s.observe(id)
+	}
+	if s.observe(3) {
+		t.Fatal("late id 3 reported as duplicate")
+	}
+	if !s.observe(3) {
+		t.Fatal("second copy of 3 not reported as duplicate")
+	}
+	old := uint32(5)
+	old -= seqWindowSize
+	if !s.observe(old) {
+		t.Fatal("id older than the window not reported as duplicate")
+	}
+	if _, gaps, _ := s.snapshot(); gaps != 1 {
+		t.Fatalf("gaps %d, want 1", gaps)
+	}
+}
+
+func TestRetransmitDeliveredOnce(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	acks := make(chan uint32, 4)
+	go func() {
+		for {
+			data, type_, err := sender.Receive()
+			if err != nil {
+				return
+			}
+			if type_ == FrameAck {
+				acks <- binary.BigEndian.Uint32(data)
+			}
+		}
+	}()
+
+	go func() {
+		id, _ := sender.SendMessage([]byte("first"), true)
+		// 模拟应答丢失后的重传
+		p := &pendingAck{ctrl: ctrlNeedAck, data: []byte("first")}
+		sender.resendData(p, id)
+		sender.resendData(p, id)
+		sender.Send([]byte("second"), false)
+	}()
+
+	for _, want := range []string{"first", "second"} {
+		data, _, err := receiver.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if id := <-acks; id != 1 {
+			t.Fatalf("ack for %d, want 1", id)
+		}
+	}
+	if _, dups := receiver.SeqGaps(); dups != 2 {
+		t.Fatalf("duplicates %d, want 2", dups)
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sender.SendAndWait(ctx, []byte("tick")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendAndWaitNoAck(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	// 对方只读取不应答
+	go io.Copy(io.Discard, c2)
+
+	sender := NewConnWithOptions(&c1, ConnOptions{
+		Retry: RetryPolicy{MaxRetries: 2, Backoff: 10 * time.Millisecond, Multiplier: 2},
+	})
+	results := make(chan error, 1)
+	_, err := sender.SendWithOptions([]byte("tick"), SendOptions{
+		NeedAck: true,
+		OnResult: func(_ uint32, err error) {
+			results <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results; !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("OnResult err %v, want ErrAckTimeout", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sender.SendAndWait(ctx, []byte("tick")); !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("SendAndWait err %v, want ErrAckTimeout", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := sender.SendAndWait(ctx, []byte("tick")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendAndWait err %v, want context.Canceled", err)
+	}
+}
+
+func TestReceiveContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := receiver.ReceiveContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := receiver.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v, want context.DeadlineExceeded", err)
+	}
+
+	// 在数据包边界被中断时连接仍然可用
+	go sender.Send([]byte("still alive"), false)
+	data, _, err := receiver.ReceiveContext(context.Background())
+	if err != nil || string(data) != "still alive" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if receiver.IsClosed() {
+		t.Fatal("receiver closed after interrupted read")
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender := NewConn(&c1)
+
+	// 没有人读取，写入会一直阻塞
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sender.SendContext(ctx, []byte("blocked"), false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v, want context.DeadlineExceeded", err)
+	}
+
+	receiver := NewConn(&c2)
+	go sender.Send([]byte("after timeout"), false)
+	data, _, err := receiver.Receive()
+	if err != nil || string(data) != "after timeout" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestKeepaliveRTT(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	opts := DefaultConnOptions()
+	opts.Keepalive = KeepaliveOptions{Interval: 5 * time.Millisecond}
+	sender, receiver := NewConnWithOptions(&c1, opts), NewConn(&c2)
+	defer sender.Close()
+
+	go func() {
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sender.Stats().PongsReceived < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pongs received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := sender.Stats()
+	if stats.SmoothedRTT <= 0 || stats.LastPong.IsZero() || stats.MissedPongs != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestKeepalivePeerDead(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	// 对方只读取不回复 pong
+	go io.Copy(io.Discard, c2)
+
+	opts := DefaultConnOptions()
+	opts.Keepalive = KeepaliveOptions{Interval: 5 * time.Millisecond, MaxMissed: 2}
+	conn := NewConnWithOptions(&c1, opts)
+
+	if _, _, err := conn.Receive(); !errors.Is(err, ErrPeerDead) {
+		t.Fatalf("err %v, want ErrPeerDead", err)
+	}
+	if !conn.IsClosed() {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestKeepaliveStuckWriter(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	opts := DefaultConnOptions()
+	opts.Keepalive = KeepaliveOptions{Interval: 50 * time.Millisecond, MaxMissed: 2}
+	conn := NewConnWithOptions(&c1, opts)
+
+	// 对方不读取，发送卡在写入上并一直持有写锁，ping 写不出去
+	sent := make(chan error, 1)
+	go func() { sent <- conn.Send([]byte("stuck"), false) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("send returned %v while the peer is not reading", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !conn.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still open, stats %+v", conn.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-sent; err == nil {
+		t.Fatal("send succeeded after the peer was declared dead")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	serverOpts := DefaultConnOptions()
+	serverOpts.Limits.MaxMessageSize = 1024
+	clientOpts := DefaultConnOptions()
+	clientOpts.Keepalive.Interval = time.Hour
+	clientOpts.ReceiveStreams = []uint16{StreamBulk}
+	client, server := NewConnWithOptions(&c1, clientOpts), NewConnWithOptions(&c2, serverOpts)
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _, err := server.Receive()
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	features, err := client.Handshake(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.Version != ProtocolVersion || !features.Capabilities.Has(CapChecksum) || features.MaxMessageSize != 1024 {
+		t.Fatalf("unexpected features %+v", features)
+	}
+	if _, err := client.SendMessage(make([]byte, 1025), false); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("err %v, want ErrFrameTooLarge", err)
+	}
+	if err := client.Send([]byte("after hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; string(data) != "after hello" {
+		t.Fatalf("got %q", data)
+	}
+	serverFeatures, ok := server.Features()
+	if !ok || serverFeatures.KeepaliveInterval != time.Hour || !slices.Equal(serverFeatures.ReceiveStreams, []uint16{StreamBulk}) ||
+		!client.checksum.Load() || !server.checksum.Load() {
+		t.Fatalf("server features %+v, %v", serverFeatures, ok)
+	}
+}
+
+func TestHandshakeRetryLossy(t *testing.T) {
+	// 只在可能丢失数据包的传输层上重发 HELLO
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	reliable, _ := PipeConn(PipeOptions{Reorder: 0.5})
+	lossy, _ := PipeConn(PipeOptions{Loss: 0.1})
+	var udp net.Conn = &udpConn{}
+	cases := []struct {
+		conn net.Conn
+		want bool
+	}{
+		{c1, false},
+		{reliable, false},
+		{lossy, true},
+		{udp, true},
+	}
+	for i, tc := range cases {
+		if got := NewConn(&tc.conn).lossy(); got != tc.want {
+			t.Errorf("case %d: lossy %v, want %v", i, got, tc.want)
+		}
+	}
+	reliable.Close()
+	lossy.Close()
+}
+
+func TestHandshakeIncompatible(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	clientOpts := DefaultConnOptions()
+	clientOpts.Handshake.Required = CapCompression
+	serverOpts := DefaultConnOptions()
+	serverOpts.Handshake.Capabilities = CapChecksum
+	client, server := NewConnWithOptions(&c1, clientOpts), NewConnWithOptions(&c2, serverOpts)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.Receive()
+		serverErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Handshake(ctx); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("client err %v, want ErrIncompatiblePeer", err)
+	}
+	if err := <-serverErr; !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("server err %v, want ErrIncompatiblePeer", err)
+	}
+	if !client.IsClosed() || !server.IsClosed() {
+		t.Fatal("connections not closed")
+	}
+}
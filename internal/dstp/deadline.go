@@ -0,0 +1,98 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// 用一个早已过去的时间作为截止时间，立即中断阻塞中的读写
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connDeadline 合并 ctx 和读取超时对连接读/写截止时间的设置
+type connDeadline struct {
+	mtx         sync.Mutex
+	set         func(time.Time) error
+	ctxDeadline time.Time // ctx 的截止时间
+	interrupted bool      // ctx 已结束
+	timeout     time.Time // 数据包头部的读取超时
+}
+
+func newConnDeadline(set func(time.Time) error) *connDeadline {
+	return &connDeadline{set: set}
+}
+
+// apply 在持有锁时调用，取各项中最早的截止时间
+func (d *connDeadline) apply() {
+	if d.interrupted {
+		d.set(aLongTimeAgo)
+		return
+	}
+	deadline := d.ctxDeadline
+	if !d.timeout.IsZero() && (deadline.IsZero() || d.timeout.Before(deadline)) {
+		deadline = d.timeout
+	}
+	d.set(deadline)
+}
+
+func (d *connDeadline) setTimeout(t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.timeout = t
+	d.apply()
+}
+
+// ctxExpired 返回超时是否由 ctx 引起
+func (d *connDeadline) ctxExpired() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.interrupted || (!d.ctxDeadline.IsZero() && !time.Now().Before(d.ctxDeadline))
+}
+
+// watch 将 ctx 的截止时间和取消映射到连接的截止时间
+// 返回的函数在读写结束后调用，清除 ctx 的设置
+func (d *connDeadline) watch(ctx context.Context) (restore func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	d.mtx.Lock()
+	d.ctxDeadline, _ = ctx.Deadline()
+	d.apply()
+	d.mtx.Unlock()
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		d.interrupted = true
+		d.apply()
+		close(fired)
+	})
+	return func() {
+		if !stop() {
+			<-fired
+		}
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		d.ctxDeadline = time.Time{}
+		d.interrupted = false
+		d.apply()
+	}
+}
+
+// contextError 读写因 ctx 设置的截止时间失败时返回对应的 ctx 错误，否则返回 nil
+func contextError(ctx context.Context, err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	// 连接的截止时间可能比 ctx 的计时器先触发
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
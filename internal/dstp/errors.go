@@ -0,0 +1,41 @@
+package dstp
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrClosed 连接已关闭，与 io.ErrClosedPipe 是同一个值
+	ErrClosed = io.ErrClosedPipe
+	// ErrBadStartByte 数据包开始位置不是开始标记
+	ErrBadStartByte = errors.New("dstp: invalid data start")
+	// ErrBadTerminator 分段后面既不是继续标识也不是结束标记
+	ErrBadTerminator = errors.New("dstp: invalid data end")
+	// ErrFrameTooLarge 数据包超过允许的大小
+	ErrFrameTooLarge = errors.New("dstp: frame too large")
+	// ErrTooManySegments 数据包的分段数超过限制
+	ErrTooManySegments = errors.New("dstp: too many segments")
+	// ErrHeaderTimeout 收到开始标记后没有在限定时间内读完头部
+	ErrHeaderTimeout = errors.New("dstp: frame header timeout")
+	// ErrChecksum 数据包的校验和不匹配，该数据包已被丢弃
+	ErrChecksum = errors.New("dstp: checksum mismatch")
+	// ErrIncompatiblePeer 握手时发现对方的协议版本或能力不兼容
+	ErrIncompatiblePeer = errors.New("dstp: incompatible peer")
+	// ErrHandshake 握手数据格式错误或握手过程中收到了其他数据
+	ErrHandshake = errors.New("dstp: handshake failed")
+	// ErrCompression 压缩数据无法解压或使用了未注册的压缩算法，该数据包已被丢弃
+	ErrCompression = errors.New("dstp: bad compressed payload")
+	// ErrWouldBlock 对方的接收窗口已用完，非阻塞发送没有发出消息
+	ErrWouldBlock = errors.New("dstp: send window full")
+	// ErrAckTimeout 重传次数用完或超过总时长仍未收到应答
+	ErrAckTimeout = errors.New("dstp: ack timeout")
+	// ErrStreamBroken 按流接收的消息缺少分块，已读出的数据不完整
+	ErrStreamBroken = errors.New("dstp: stream message incomplete")
+	// ErrStreamOverflow 应用读取按流接收的消息太慢，缓存超过 MaxMessageSize，之后的分块已被丢弃
+	ErrStreamOverflow = errors.New("dstp: stream reader overflow")
+	// ErrNotConnected 重连客户端正在重连，不需要应答的消息没有发出
+	ErrNotConnected = errors.New("dstp: not connected")
+	// ErrPeerDead keepalive 连续多个周期没有收到 pong
+	ErrPeerDead = errors.New("dstp: peer not responding")
+)
@@ -0,0 +1,291 @@
+package dstp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 发送窗口用完后向对方查询窗口的间隔，防止通告窗口的扩展包丢失后一直等待
+const windowProbeInterval = time.Second
+
+// FlowControlOptions 基于信用的流量控制
+// 接收方按消息数通告窗口，发送方最多比对方已接收的最大消息id多发送 Window 条消息
+// 只在握手协商出 CapFlowControl 后生效，ping、ack 和重传不占用窗口
+type FlowControlOptions struct {
+	Window int // 本端的接收窗口(消息数)，0 表示不限制对方，超过去重窗口的大小时按去重窗口计算
+}
+
+// 初始窗口随 hello 交换，之后用 WINDOW 扩展包更新: |extWindow|允许的最大消息id(4)|
+// 只有扩展类型时为查询，收到后回复当前窗口
+
+// sendWindow 发送方记录的对方窗口
+type sendWindow struct {
+	mtx     sync.Mutex
+	enabled bool          // 收到对方的第一次通告后开始限制
+	limit   uint32        // 对方允许的最大消息id
+	changed chan struct{} // limit 变化时关闭并替换
+	waiting int           // 正在等待窗口的发送数
+	blocked uint64
+}
+
+// allows 判断消息id是否在对方的窗口内
+func (w *sendWindow) allows(messageId uint32) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return !w.enabled || !SeqLess(w.limit, messageId)
+}
+
+// update 收到对方通告的窗口，乱序到达的旧通告被忽略
+func (w *sendWindow) update(limit uint32) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.enabled && !SeqLess(w.limit, limit) {
+		return
+	}
+	w.enabled = true
+	w.limit = limit
+	if w.changed != nil {
+		close(w.changed)
+		w.changed = nil
+	}
+}
+
+// remaining 返回从 lastId 之后还能发送的消息数，没有限制时返回 -1
+func (w *sendWindow) remaining(lastId uint32) int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.enabled {
+		return -1
+	}
+	return max(int(int32(w.limit-lastId)), 0)
+}
+
+// recvWindow 接收方通告给对方的窗口
+type recvWindow struct {
+	mtx        sync.Mutex
+	enabled    bool
+	advertised uint32 // 最近通告的最大消息id
+}
+
+// remaining 返回对方在 lastId 之后还能发送的消息数，没有启用时返回 -1
+func (w *recvWindow) remaining(lastId uint32) int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.enabled {
+		return -1
+	}
+	return max(int(int32(w.advertised-lastId)), 0)
+}
+
+// waitWindow 等待对方的窗口容纳下一条消息
+// nonBlocking 为 true 时不等待，返回 ErrWouldBlock
+func (c *Conn) waitWindow(ctx context.Context, nonBlocking bool) error {
+	w := &c.sendWin
+	counted := false
+	var probe *time.Ticker
+	defer func() {
+		if probe != nil {
+			probe.Stop()
+		}
+		if counted {
+			w.mtx.Lock()
+			w.waiting--
+			w.mtx.Unlock()
+		}
+	}()
+	for {
+		w.mtx.Lock()
+		if !w.enabled || !SeqLess(w.limit, c.nextId.Load()+1) {
+			w.mtx.Unlock()
+			return nil
+		}
+		if !counted {
+			w.blocked++
+			if nonBlocking {
+				w.mtx.Unlock()
+				return ErrWouldBlock
+			}
+			w.waiting++
+			counted = true
+		}
+		if w.changed == nil {
+			w.changed = make(chan struct{})
+		}
+		changed := w.changed
+		w.mtx.Unlock()
+
+		if probe == nil {
+			probe = time.NewTicker(windowProbeInterval)
+		}
+		select {
+		case <-changed:
+		case <-probe.C:
+			c.sendExt(ctx, []byte{extWindow})
+		case <-c.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// onWindow 收到对方通告的窗口或窗口查询
+func (c *Conn) onWindow(data []byte) error {
+	if len(data) == 0 {
+		return c.advertiseWindow(true)
+	}
+	if len(data) < 4 {
+		return fmt.Errorf("%w: short window", ErrHandshake)
+	}
+	c.sendWin.update(binary.BigEndian.Uint32(data))
+	return nil
+}
+
+// windowSize 本端的接收窗口，0 表示不启用
+func (c *Conn) windowSize() uint32 {
+	if !c.opts.Handshake.Capabilities.Has(CapFlowControl) {
+		return 0
+	}
+	return uint32(min(max(c.opts.FlowControl.Window, 0), seqWindowSize))
+}
+
+// initialWindow 握手时通告的窗口，0 表示不限制对方
+func (c *Conn) initialWindow() uint32 {
+	if size := c.windowSize(); size > 0 {
+		return c.LastReceivedId() + size
+	}
+	return 0
+}
+
+// advertiseWindow 按已接收的最大消息id通告窗口
+// 窗口用掉一半以上或 force 为 true 时才发送，避免每条消息都回复一个扩展包
+func (c *Conn) advertiseWindow(force bool) error {
+	size := c.windowSize()
+	w := &c.recvWin
+	w.mtx.Lock()
+	if !w.enabled {
+		w.mtx.Unlock()
+		return nil
+	}
+	limit := c.LastReceivedId() + size
+	if !force && int32(limit-w.advertised) < int32(max(size/2, 1)) {
+		w.mtx.Unlock()
+		return nil
+	}
+	w.advertised = limit
+	w.mtx.Unlock()
+	return c.sendExt(context.Background(), binary.BigEndian.AppendUint32([]byte{extWindow}, limit))
+}
+
+// enableFlowControl 握手协商出流量控制后按双方在 hello 中通告的窗口开始限制
+// 初始窗口随 hello 交换，握手期间不需要额外写出数据包
+func (c *Conn) enableFlowControl(peerWindow uint32) {
+	if peerWindow != 0 {
+		c.sendWin.update(peerWindow)
+	}
+	if window := c.initialWindow(); window != 0 {
+		c.recvWin.mtx.Lock()
+		c.recvWin.enabled = true
+		c.recvWin.advertised = window
+		c.recvWin.mtx.Unlock()
+	}
+}
+
+// 按流接收的消息使用分块信用控制发送速度，接收方的应用读得慢时发送方随之放慢，不需要缓存整条消息
+// 双方协商出 CapFlowControl 且消息所在的流在对方的 ReceiveStreams 中时生效，重传不占用信用
+// 每条消息的初始信用为 streamCreditParts 个分块，之后用 STREAM-CREDIT 扩展包更新:
+// |extStreamCredit|流id(2)|消息id(4)|允许发送的分块数(4)|
+// 没有分块数时为查询，收到后回复当前信用，接收方已经不再读取这条消息时不再限制
+const streamCreditParts = 64
+
+// streamCredit 发送方记录的对方为一个流上的消息给出的信用
+type streamCredit struct {
+	id      uint32        // 信用对应的消息id
+	parts   uint32        // 允许发送的分块数
+	changed chan struct{} // 信用变化时关闭并替换
+}
+
+// waitStreamCredit 等待对方允许发送消息的第 part 个分块
+func (c *Conn) waitStreamCredit(ctx context.Context, stream uint16, messageId uint32, part int) error {
+	if part < streamCreditParts {
+		return nil
+	}
+	var probe *time.Ticker
+	defer func() {
+		if probe != nil {
+			probe.Stop()
+		}
+	}()
+	for {
+		c.streamMtx.Lock()
+		cr := c.credits[stream]
+		if cr == nil {
+			cr = &streamCredit{}
+			c.credits[stream] = cr
+		}
+		if cr.id == messageId && int64(cr.parts) > int64(part) {
+			c.streamMtx.Unlock()
+			return nil
+		}
+		if cr.changed == nil {
+			cr.changed = make(chan struct{})
+		}
+		changed := cr.changed
+		c.streamMtx.Unlock()
+
+		if probe == nil {
+			probe = time.NewTicker(windowProbeInterval)
+		}
+		select {
+		case <-changed:
+		case <-probe.C:
+			query := binary.BigEndian.AppendUint16([]byte{extStreamCredit}, stream)
+			c.sendExt(ctx, binary.BigEndian.AppendUint32(query, messageId))
+		case <-c.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// onStreamCredit 收到对方给出的信用或信用查询，查询在接收协程中读取正在接收的消息
+func (c *Conn) onStreamCredit(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("%w: short stream credit", ErrHandshake)
+	}
+	stream, id := binary.BigEndian.Uint16(data), binary.BigEndian.Uint32(data[2:])
+	if len(data) < 10 {
+		parts := uint32(maxParts)
+		if in := c.inbound[stream]; in != nil && in.id == id && in.r != nil {
+			parts = in.r.credited()
+		}
+		return c.sendStreamCredit(stream, id, parts)
+	}
+	parts := binary.BigEndian.Uint32(data[6:])
+	c.streamMtx.Lock()
+	defer c.streamMtx.Unlock()
+	cr := c.credits[stream]
+	if cr == nil {
+		cr = &streamCredit{}
+		c.credits[stream] = cr
+	} else if cr.id == id && cr.parts >= parts || cr.id != id && SeqLess(id, cr.id) {
+		// 乱序到达的旧信用
+		return nil
+	}
+	cr.id, cr.parts = id, parts
+	if cr.changed != nil {
+		close(cr.changed)
+		cr.changed = nil
+	}
+	return nil
+}
+
+func (c *Conn) sendStreamCredit(stream uint16, messageId, parts uint32) error {
+	body := binary.BigEndian.AppendUint16([]byte{extStreamCredit}, stream)
+	body = binary.BigEndian.AppendUint32(body, messageId)
+	return c.sendExt(context.Background(), binary.BigEndian.AppendUint32(body, parts))
+}
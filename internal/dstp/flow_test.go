@@ -0,0 +1,135 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitStats 等待连接统计满足条件
+func waitStats(t *testing.T, c *Conn, ok func(Stats) bool) Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := c.Stats()
+		if ok(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.FlowControl.Window = 4
+	sender, receiver := PipeWithOptions(PipeOptions{}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 接收方只在测试取走消息后才继续接收，模拟处理缓慢的一端
+	got := make(chan []byte)
+	go func() {
+		for {
+			data, type_, err := receiver.Receive()
+			if err != nil {
+				close(got)
+				return
+			}
+			if type_ == FrameMessage {
+				got <- data
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := sender.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	if s := sender.Stats(); s.SendWindow != 4 {
+		t.Fatalf("send window %d, want 4", s.SendWindow)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if _, err := sender.SendWithOptions([]byte{byte(i)}, SendOptions{NonBlocking: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sender.SendWithOptions([]byte{5}, SendOptions{NonBlocking: true}); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("got %v, want ErrWouldBlock", err)
+	}
+
+	// 阻塞发送等待接收方取走消息后通告新的窗口
+	sent := make(chan error, 1)
+	go func() { sent <- sender.SendContext(ctx, []byte{5}, false) }()
+	s := waitStats(t, sender, func(s Stats) bool { return s.SendWaiting == 1 })
+	if s.SendWindow != 0 || s.SendBlocked != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+	for i := 1; i <= 5; i++ {
+		data := <-got
+		if len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("got %v, want %d", data, i)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	waitStats(t, sender, func(s Stats) bool { return s.SendWaiting == 0 && s.SendWindow > 0 })
+	if s := receiver.Stats(); s.RecvWindow <= 0 || s.RecvWindow > 4 {
+		t.Fatalf("receive window %d", s.RecvWindow)
+	}
+}
+
+func TestFlowControlProbe(t *testing.T) {
+	// 通告窗口的扩展包丢失时，阻塞的发送方定期查询窗口
+	opts := DefaultConnOptions()
+	opts.FlowControl.Window = 2
+	sender, receiver := PipeWithOptions(PipeOptions{}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+	go func() {
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := sender.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	sender.Send([]byte{1}, false)
+	sender.Send([]byte{2}, false)
+	// 等待接收方按收到的消息通告新的窗口，再让发送方回到旧的窗口
+	waitStats(t, sender, func(s Stats) bool { return s.SendWindow == 2 })
+	sender.sendWin.mtx.Lock()
+	sender.sendWin.limit = 2
+	sender.sendWin.mtx.Unlock()
+
+	start := time.Now()
+	if err := sender.SendContext(ctx, []byte{3}, false); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < windowProbeInterval/2 {
+		t.Fatalf("sent after %v without probing", elapsed)
+	}
+}
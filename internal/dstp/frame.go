@@ -0,0 +1,401 @@
+package dstp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sync"
+)
+
+// 单个分段最大数据长度
+const maxSegmentLen = (1 << 16) - 1
+
+// 接收缓冲区大小
+const readBufSize = 4096
+
+// 校验和长度
+const checksumLen = 4
+
+// CRC32C 校验和使用的多项式表
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// 归还到池中的缓冲区上限，避免大消息的缓冲区长期驻留
+const maxPooledBufCap = 1 << 20
+
+// FrameType 数据包类型
+type FrameType int
+
+const (
+	FrameMessage FrameType = 1 // 普通消息
+	FramePing    FrameType = 2 // ping包
+	FramePong    FrameType = 3 // pong包
+	FrameAck     FrameType = 4 // ack应答
+	// FrameCorrupted 恢复模式下跳过的损坏数据，Discarded 为丢弃的字节数
+	FrameCorrupted FrameType = 5
+	// FrameStream 按流接收的分块消息，收到第一个分块时交付，数据从 Reader 中读取
+	FrameStream FrameType = 6
+
+	// 握手等扩展包，由 Conn 内部处理，不会返回给调用方
+	frameExt FrameType = 100
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameMessage:
+		return "message"
+	case FramePing:
+		return "ping"
+	case FramePong:
+		return "pong"
+	case FrameAck:
+		return "ack"
+	case FrameCorrupted:
+		return "corrupted"
+	case FrameStream:
+		return "stream"
+	case frameExt:
+		return "ext"
+	default:
+		return fmt.Sprintf("FrameType(%d)", int(t))
+	}
+}
+
+// Frame 接收到的一个数据包
+type Frame struct {
+	Id        uint32        // 消息id，ack 包为被应答的消息id，ping/pong 包为 0
+	Type      FrameType     // 数据包类型
+	Flags     byte          // 控制标记
+	Payload   []byte        // 数据，多个分段已拼接
+	Segments  int           // 分段数
+	Discarded int           // 损坏数据包丢弃的字节数
+	Stream    uint16        // 消息所在的流，不带流头时为 0
+	Priority  Priority      // 发送方设置的优先级，不带流头时为 PriorityNormal
+	Reader    *StreamReader // FrameStream 的消息内容，其他类型为 nil
+
+	part    uint16 // 分块序号
+	last    bool   // 是否为最后一个分块
+	aborted bool   // 发送方放弃了这条消息
+}
+
+// frameEncoder 将整个数据包(包括所有分段)组装进同一个缓冲区，再一次性写出
+// checksum 为 true 时在头部加入校验和，写出前由 seal 计算
+type frameEncoder struct {
+	buf      []byte
+	checksum bool
+	sumAt    int // 校验和在 buf 中的位置
+
+	// 统计和追踪使用的头部信息，见 info
+	typ    FrameType
+	stream uint16
+	segs   int
+}
+
+var encoderPool = sync.Pool{
+	New: func() any {
+		return &frameEncoder{buf: make([]byte, 0, 1024)}
+	},
+}
+
+func getEncoder() *frameEncoder {
+	e := encoderPool.Get().(*frameEncoder)
+	e.buf = e.buf[:0]
+	e.checksum = false
+	e.typ, e.stream, e.segs = 0, 0, 0
+	return e
+}
+
+func putEncoder(e *frameEncoder) {
+	if cap(e.buf) > maxPooledBufCap {
+		return
+	}
+	encoderPool.Put(e)
+}
+
+// segmentCount 返回数据需要的分段数，空数据也占一个分段
+func segmentCount(dataLen int) int {
+	if dataLen == 0 {
+		return 1
+	}
+	return (dataLen + maxSegmentLen - 1) / maxSegmentLen
+}
+
+// frameSize 返回数据包编码后的总长度
+func frameSize(dataLen int) int {
+	segment := segmentCount(dataLen)
+	// 开始标记 + 控制标记 + 消息id + 每段(长度 + 继续/结束标记) + 数据
+	return 1 + 1 + 4 + segment*(2+1) + dataLen
+}
+
+func (e *frameEncoder) grow(n int) {
+	if cap(e.buf)-len(e.buf) < n {
+		buf := make([]byte, len(e.buf), len(e.buf)+n)
+		copy(buf, e.buf)
+		e.buf = buf
+	}
+}
+
+// data |开始标记|控制标记|消息id|数据长度|数据|继续标识|数据长度|数据|结束标记|
+func (e *frameEncoder) data(ctrl byte, messageId uint32, data []byte) {
+	e.grow(frameSize(len(data)) + checksumLen)
+	e.header(ctrl, messageId, len(data))
+	e.segments(data)
+}
+
+// streamData 带流头的数据包，流头在消息id和校验和之后
+// |开始标记|控制标记|消息id|流id|优先级|分块序号|标记|数据长度|数据|结束标记|
+func (e *frameEncoder) streamData(ctrl byte, messageId uint32, s streamInfo, part uint16, last bool, data []byte) {
+	var flags byte
+	if last {
+		flags |= streamLastPart
+	}
+	e.streamPart(ctrl, messageId, s, part, flags, data)
+}
+
+// abortStream 放弃消息的分块，分块序号为下一个分块，没有数据
+func (e *frameEncoder) abortStream(ctrl byte, messageId uint32, s streamInfo, part uint16) {
+	e.streamPart(ctrl, messageId, s, part, streamAborted, nil)
+}
+
+func (e *frameEncoder) streamPart(ctrl byte, messageId uint32, s streamInfo, part uint16, flags byte, data []byte) {
+	e.grow(frameSize(len(data)) + checksumLen + streamHeaderLen)
+	e.header(ctrl|ctrlStream, messageId, len(data))
+	e.stream = s.stream
+	e.buf = binary.BigEndian.AppendUint16(e.buf, s.stream)
+	e.buf = append(e.buf, byte(s.priority))
+	e.buf = binary.BigEndian.AppendUint16(e.buf, part)
+	e.buf = append(e.buf, flags)
+	e.segments(data)
+}
+
+// header 写入开始标记、控制标记和消息id，需要时预留校验和
+func (e *frameEncoder) header(ctrl byte, messageId uint32, dataLen int) {
+	if segmentCount(dataLen) > 1 {
+		ctrl |= ctrlSeg
+	}
+	e.typ = FrameMessage
+	if ctrl&ctrlExt == ctrlExt {
+		e.typ = frameExt
+	}
+	e.buf = append(e.buf, dataStart, ctrl)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, messageId)
+	e.reserveChecksum()
+}
+
+// segments 写入各分段数据和结束标记
+func (e *frameEncoder) segments(data []byte) {
+	segment := segmentCount(len(data))
+	e.segs = segment
+	for i := 0; i < segment; i++ {
+		start := i * maxSegmentLen
+		end := min(start+maxSegmentLen, len(data))
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(end-start))
+		e.buf = append(e.buf, data[start:end]...)
+		if i == segment-1 {
+			e.buf = append(e.buf, dataEnd)
+		} else {
+			e.buf = append(e.buf, dataContinue)
+		}
+	}
+}
+
+// setId 改写已编码数据包的消息id
+func (e *frameEncoder) setId(messageId uint32) {
+	binary.BigEndian.PutUint32(e.buf[2:6], messageId)
+}
+
+// ack |0x01|00000010|应答消息id|0x03|
+func (e *frameEncoder) ack(messageId uint32) {
+	e.typ = FrameAck
+	e.buf = append(e.buf, dataStart, ctrlIfAck)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, messageId)
+	e.reserveChecksum()
+	e.buf = append(e.buf, dataEnd)
+}
+
+// ping |0x01|00011000|0x03|
+func (e *frameEncoder) ping() {
+	e.typ = FramePing
+	e.buf = append(e.buf, dataStart, ctrlIfPing|ctrlPing)
+	e.reserveChecksum()
+	e.buf = append(e.buf, dataEnd)
+}
+
+// pong |0x01|00010000|0x03|
+func (e *frameEncoder) pong() {
+	e.typ = FramePong
+	e.buf = append(e.buf, dataStart, ctrlIfPing)
+	e.reserveChecksum()
+	e.buf = append(e.buf, dataEnd)
+}
+
+// reserveChecksum 需要校验和时设置控制标记并在头部末尾预留位置
+func (e *frameEncoder) reserveChecksum() {
+	if !e.checksum {
+		return
+	}
+	e.buf[1] |= ctrlChecksum
+	e.sumAt = len(e.buf)
+	e.buf = append(e.buf, 0, 0, 0, 0)
+}
+
+// seal 计算并填入校验和，覆盖开始标记之后除校验和本身以外的所有字节
+// 必须在 setId 之后调用
+func (e *frameEncoder) seal() {
+	if !e.checksum {
+		return
+	}
+	sum := crc32.Update(0, castagnoli, e.buf[1:e.sumAt])
+	sum = crc32.Update(sum, castagnoli, e.buf[e.sumAt+checksumLen:])
+	binary.BigEndian.PutUint32(e.buf[e.sumAt:], sum)
+}
+
+// frameDecoder 在带缓冲的连接上解析数据包，头部字段复用同一块暂存区
+type frameDecoder struct {
+	r        *bufio.Reader
+	scratch  [4]byte
+	partial  bool // 已读到开始标记，数据包尚未读完
+	consumed int  // 当前数据包已读取的字节数
+	sum      bool // 当前数据包带校验和，读取时累计 crc
+	crc      uint32
+	want     uint32 // 数据包头部携带的校验和
+}
+
+func newFrameDecoder(r io.Reader) *frameDecoder {
+	return &frameDecoder{r: bufio.NewReaderSize(r, readBufSize)}
+}
+
+// readStart 读取数据包的第一个字节，连接正常关闭时返回 io.EOF
+func (d *frameDecoder) readStart() (byte, error) {
+	d.partial = false
+	d.consumed = 0
+	d.sum = false
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.partial = true
+		d.consumed = 1
+	}
+	return b, err
+}
+
+// readByte 读取数据包中间的字节，此时遇到 EOF 说明数据包不完整
+func (d *frameDecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.consumed++
+	if d.sum {
+		d.scratch[0] = b
+		d.update(d.scratch[:1])
+	}
+	return b, nil
+}
+
+func (d *frameDecoder) readUint16() (uint16, error) {
+	_, err := io.ReadFull(d.r, d.scratch[:2])
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.consumed += 2
+	d.update(d.scratch[:2])
+	return binary.BigEndian.Uint16(d.scratch[:2]), nil
+}
+
+func (d *frameDecoder) readUint32() (uint32, error) {
+	_, err := io.ReadFull(d.r, d.scratch[:4])
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.consumed += 4
+	d.update(d.scratch[:4])
+	return binary.BigEndian.Uint32(d.scratch[:4]), nil
+}
+
+// readPayload 读取 n 字节追加到 dst 后面，dst 容量足够时不分配内存
+func (d *frameDecoder) readPayload(dst []byte, n int) ([]byte, error) {
+	l := len(dst)
+	dst = slices.Grow(dst, n)[:l+n]
+	_, err := io.ReadFull(d.r, dst[l:])
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.consumed += n
+	d.update(dst[l:])
+	return dst, nil
+}
+
+// beginChecksum 控制标记带校验位时调用，之后读取的字节都计入 crc
+func (d *frameDecoder) beginChecksum(ctrl byte) {
+	d.sum = true
+	d.scratch[0] = ctrl
+	d.crc = crc32.Update(0, castagnoli, d.scratch[:1])
+}
+
+func (d *frameDecoder) update(p []byte) {
+	if d.sum {
+		d.crc = crc32.Update(d.crc, castagnoli, p)
+	}
+}
+
+// readChecksum 读取头部的校验和，校验和本身不计入 crc
+func (d *frameDecoder) readChecksum() error {
+	_, err := io.ReadFull(d.r, d.scratch[:4])
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	d.consumed += 4
+	d.want = binary.BigEndian.Uint32(d.scratch[:4])
+	return nil
+}
+
+// checksumOk 数据包读完后比较累计的 crc 和头部的校验和
+func (d *frameDecoder) checksumOk() bool {
+	return !d.sum || d.crc == d.want
+}
+
+// readEnd 读取并校验结束标记
+func (d *frameDecoder) readEnd() error {
+	b, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	if b != dataEnd {
+		return fmt.Errorf("%w: 0x%02x", ErrBadTerminator, b)
+	}
+	return nil
+}
+
+// resync 丢弃损坏的数据直到下一个开始标记(不读取开始标记)，返回丢弃的总字节数
+// 位置不对的结束标记可能正是下一个数据包的开始标记，退回后再查找
+func (d *frameDecoder) resync(err error) (int, error) {
+	discarded := d.consumed
+	if errors.Is(err, ErrBadTerminator) && d.r.UnreadByte() == nil {
+		discarded--
+	}
+	d.partial = false
+	d.consumed = 0
+	for {
+		if _, err := d.r.Peek(1); err != nil {
+			return discarded, err
+		}
+		buf, _ := d.r.Peek(d.r.Buffered())
+		if i := bytes.IndexByte(buf, dataStart); i >= 0 {
+			d.r.Discard(i)
+			return discarded + i, nil
+		}
+		d.r.Discard(len(buf))
+		discarded += len(buf)
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
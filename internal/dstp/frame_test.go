@@ -0,0 +1,474 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// countWriter 记录 Write 调用次数
+type countWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// writeTo 用一次 Write 写出整个数据包
+func (e *frameEncoder) writeTo(w io.Writer) error {
+	_, err := w.Write(e.buf)
+	return err
+}
+
+func TestEncodeSingleWrite(t *testing.T) {
+	for _, size := range []int{0, 40, maxSegmentLen, maxSegmentLen + 1, 3*maxSegmentLen + 7} {
+		w := &countWriter{}
+		e := getEncoder()
+		e.data(ctrlNeedAck, 42, bytes.Repeat([]byte{'x'}, size))
+		if err := e.writeTo(w); err != nil {
+			t.Fatal(err)
+		}
+		putEncoder(e)
+		if w.writes != 1 {
+			t.Errorf("size %d: %d writes, want 1", size, w.writes)
+		}
+		if w.Len() != frameSize(size) {
+			t.Errorf("size %d: encoded %d bytes, want %d", size, w.Len(), frameSize(size))
+		}
+	}
+}
+
+func TestEncodeSegments(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, maxSegmentLen+1)
+	e := getEncoder()
+	defer putEncoder(e)
+	e.data(0, 1, data)
+
+	buf := e.buf
+	if buf[0] != dataStart || buf[1] != ctrlSeg {
+		t.Fatalf("bad header % x", buf[:2])
+	}
+	// 第一段结束后应为继续标识
+	if buf[6+2+maxSegmentLen] != dataContinue {
+		t.Fatalf("missing continue marker")
+	}
+	if buf[len(buf)-1] != dataEnd {
+		t.Fatalf("missing end marker")
+	}
+}
+
+func benchmarkEncode(b *testing.B, size int) {
+	data := bytes.Repeat([]byte{'x'}, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e := getEncoder()
+		e.data(ctrlNeedAck, uint32(i), data)
+		e.writeTo(io.Discard)
+		putEncoder(e)
+	}
+}
+
+func BenchmarkEncode40(b *testing.B)   { benchmarkEncode(b, 40) }
+func BenchmarkEncode1K(b *testing.B)   { benchmarkEncode(b, 1<<10) }
+func BenchmarkEncode64K(b *testing.B)  { benchmarkEncode(b, maxSegmentLen) }
+func BenchmarkEncode256K(b *testing.B) { benchmarkEncode(b, 1<<18) }
+
+func benchmarkSend(b *testing.B, size int) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	conn := NewConn(&c1)
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte{'x'}, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.Send(data, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSend40(b *testing.B)  { benchmarkSend(b, 40) }
+func BenchmarkSend1K(b *testing.B)  { benchmarkSend(b, 1<<10) }
+func BenchmarkSend64K(b *testing.B) { benchmarkSend(b, maxSegmentLen) }
+
+func BenchmarkSendParallel(b *testing.B) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	conn := NewConn(&c1)
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte{'x'}, 40)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn.Send(data, false)
+		}
+	})
+}
+
+func TestReceiveInto(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	sizes := []int{0, 40, maxSegmentLen, maxSegmentLen + 1, 2*maxSegmentLen + 3}
+	go func() {
+		for i, size := range sizes {
+			sender.Send(bytes.Repeat([]byte{byte('a' + i)}, size), false)
+		}
+	}()
+
+	buf := make([]byte, 0, 64)
+	for i, size := range sizes {
+		data, type_, err := receiver.ReceiveInto(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if type_ != FrameMessage {
+			t.Fatalf("type %v, want message", type_)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte('a' + i)}, size)) {
+			t.Fatalf("size %d: payload mismatch", size)
+		}
+		buf = data
+	}
+}
+
+func BenchmarkReceiveInto(b *testing.B) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	data := bytes.Repeat([]byte{'x'}, 40)
+	go func() {
+		for sender.Send(data, false) == nil {
+		}
+	}()
+
+	var buf []byte
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, _, err := receiver.ReceiveInto(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf = d
+	}
+}
+
+func TestReceiveFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender, receiver := NewConn(&c1), NewConn(&c2)
+
+	data := bytes.Repeat([]byte{'f'}, 2*maxSegmentLen+1)
+	go sender.Send(data, false)
+
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || f.Id != 1 || f.Segments != 3 || f.Flags&ctrlSeg == 0 {
+		t.Fatalf("unexpected frame %+v", Frame{Id: f.Id, Type: f.Type, Flags: f.Flags, Segments: f.Segments})
+	}
+	if !bytes.Equal(f.Payload, data) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestReceiveBadFrame(t *testing.T) {
+	cases := []struct {
+		raw  []byte
+		want error
+	}{
+		{[]byte{0x7f}, ErrBadStartByte},
+		{[]byte{dataStart, 0, 0, 0, 0, 1, 0, 1, 'x', 0x7f}, ErrBadTerminator},
+		{[]byte{dataStart, 0, 0, 0, 0, 1, 0, 1, 'x', dataStart}, ErrBadTerminator},
+		{[]byte{dataStart, ctrlIfPing, 0x7f}, ErrBadTerminator},
+		{[]byte{dataStart, ctrlIfAck, 0, 0, 0, 1, 0x7f}, ErrBadTerminator},
+	}
+	for _, c := range cases {
+		c1, c2 := net.Pipe()
+		go c1.Write(c.raw)
+		_, _, err := NewConn(&c2).Receive()
+		if !errors.Is(err, c.want) {
+			t.Errorf("% x: err %v, want %v", c.raw, err, c.want)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestReceiveLimits(t *testing.T) {
+	cases := []struct {
+		name   string
+		limits Limits
+		send   func(c net.Conn)
+		want   error
+	}{
+		{
+			name:   "message size",
+			limits: Limits{MaxMessageSize: 100},
+			send: func(c net.Conn) {
+				NewConn(&c).Send(bytes.Repeat([]byte{'x'}, 101), false)
+			},
+			want: ErrFrameTooLarge,
+		},
+		{
+			name:   "segments",
+			limits: Limits{MaxSegments: 2},
+			send: func(c net.Conn) {
+				NewConn(&c).Send(bytes.Repeat([]byte{'x'}, 2*maxSegmentLen+1), false)
+			},
+			want: ErrTooManySegments,
+		},
+		{
+			name:   "header timeout",
+			limits: Limits{HeaderTimeout: 20 * time.Millisecond},
+			send: func(c net.Conn) {
+				c.Write([]byte{dataStart, 0})
+			},
+			want: ErrHeaderTimeout,
+		},
+	}
+	for _, tc := range cases {
+		c1, c2 := net.Pipe()
+		go tc.send(c1)
+		receiver := NewConnWithOptions(&c2, ConnOptions{Limits: tc.limits})
+		_, _, err := receiver.Receive()
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: err %v, want %v", tc.name, err, tc.want)
+		}
+		if !receiver.IsClosed() {
+			t.Errorf("%s: connection not closed", tc.name)
+		}
+		c1.Close()
+	}
+}
+
+func TestHeaderTimeoutIdle(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sender := NewConn(&c1)
+	receiver := NewConnWithOptions(&c2, ConnOptions{Limits: Limits{HeaderTimeout: 10 * time.Millisecond}})
+
+	// 空闲等待下一个数据包不受头部超时限制
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sender.Send([]byte("late"), false)
+	}()
+	data, _, err := receiver.Receive()
+	if err != nil || string(data) != "late" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestReceiveResync(t *testing.T) {
+	e := getEncoder()
+	defer putEncoder(e)
+	e.data(0, 1, []byte("ok"))
+	good := e.buf
+
+	raw := []byte{0x7f, 0x7f}                                    // 数据包之间的垃圾数据
+	raw = append(raw, dataStart, 0, 0, 0, 0, 2, 0, 1, 'x', 0x7f) // 结束标记损坏
+	raw = append(raw, dataStart, 0, 0, 0, 0, 3, 0, 1, 'y')       // 缺少结束标记，紧跟下一个数据包
+	raw = append(raw, good...)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c1.Write(raw)
+	receiver := NewConnWithOptions(&c2, ConnOptions{Resync: true})
+
+	want := []struct {
+		type_     FrameType
+		discarded int
+	}{
+		{FrameCorrupted, 2},
+		{FrameCorrupted, 10},
+		{FrameCorrupted, 9},
+		{FrameMessage, 0},
+	}
+	for _, w := range want {
+		var f Frame
+		if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != w.type_ || f.Discarded != w.discarded {
+			t.Fatalf("got %v discarded %d, want %v discarded %d", f.Type, f.Discarded, w.type_, w.discarded)
+		}
+	}
+	stats := receiver.Stats()
+	if stats.CorruptedFrames != 3 || stats.DiscardedBytes != 21 {
+		t.Fatalf("corrupted %d discarded %d, want 3 21", stats.CorruptedFrames, stats.DiscardedBytes)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	opts := DefaultConnOptions()
+	opts.Checksum = true
+	sender, receiver := NewConnWithOptions(&c1, opts), NewConnWithOptions(&c2, opts)
+
+	go func() {
+		sender.Send(bytes.Repeat([]byte{'c'}, maxSegmentLen+1), true)
+		sender.Ping()
+	}()
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || f.Flags&ctrlChecksum == 0 || len(f.Payload) != maxSegmentLen+1 {
+		t.Fatalf("unexpected frame %v flags %08b len %d", f.Type, f.Flags, len(f.Payload))
+	}
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil || f.Type != FramePing {
+		t.Fatalf("got %v, %v, want ping", f.Type, err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	e := getEncoder()
+	defer putEncoder(e)
+	e.checksum = true
+	e.data(0, 1, []byte("payload"))
+	e.seal()
+	bad := bytes.Clone(e.buf)
+	bad[len(bad)-2] ^= 0x01 // 数据中翻转一位
+
+	for _, resync := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		go func() {
+			c1.Write(bad)
+			c1.Write(e.buf)
+		}()
+		receiver := NewConnWithOptions(&c2, ConnOptions{Resync: resync})
+
+		var f Frame
+		err := receiver.ReceiveFrame(context.Background(), &f)
+		if resync {
+			if err != nil || f.Type != FrameCorrupted || f.Discarded != len(bad) {
+				t.Fatalf("resync: got %v discarded %d, %v", f.Type, f.Discarded, err)
+			}
+		} else if !errors.Is(err, ErrChecksum) {
+			t.Fatalf("err %v, want ErrChecksum", err)
+		}
+		// 校验失败的数据包被丢弃后连接仍然可用
+		if err := receiver.ReceiveFrame(context.Background(), &f); err != nil || string(f.Payload) != "payload" {
+			t.Fatalf("got %q, %v", f.Payload, err)
+		}
+		if n := receiver.Stats().ChecksumErrors; n != 1 {
+			t.Fatalf("checksum errors %d, want 1", n)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"x":1.5,"y":2.5},`), 10000)
+	for _, codec := range []Codec{NoopCodec{}, DeflateCodec{Level: 1}, GzipCodec{Level: 9}} {
+		c1, c2 := net.Pipe()
+		opts := DefaultConnOptions()
+		// 没有握手，强制压缩
+		opts.Compression = CompressionOptions{Codec: codec, Threshold: 64, Force: true}
+		sender, receiver := NewConnWithOptions(&c1, opts), NewConn(&c2)
+
+		go func() {
+			sender.Send([]byte("short"), false)
+			sender.Send(large, false)
+		}()
+
+		var f Frame
+		for _, want := range [][]byte{[]byte("short"), large} {
+			if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			if !bytes.Equal(f.Payload, want) {
+				t.Fatalf("%s: payload mismatch", codec.Name())
+			}
+			compressed := f.Flags&ctrlCompress != 0
+			if len(want) < 64 && compressed {
+				t.Fatalf("%s: short message compressed", codec.Name())
+			}
+			if _, ok := codec.(NoopCodec); !ok && len(want) >= 64 && (!compressed || f.Segments != 1) {
+				t.Fatalf("%s: compressed %v, %d segments", codec.Name(), compressed, f.Segments)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestCompressionWithoutHandshake(t *testing.T) {
+	// 没有握手的对方可能是不支持压缩的旧客户端，默认不压缩
+	c1, c2 := net.Pipe()
+	opts := DefaultConnOptions()
+	opts.Compression = CompressionOptions{Codec: DeflateCodec{Level: 1}, Threshold: 64}
+	sender, receiver := NewConnWithOptions(&c1, opts), NewConn(&c2)
+	defer sender.Close()
+	defer receiver.Close()
+
+	large := bytes.Repeat([]byte("x"), 1024)
+	go sender.Send(large, false)
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Flags&ctrlCompress != 0 || !bytes.Equal(f.Payload, large) {
+		t.Fatalf("flags %08b, %d bytes", f.Flags, len(f.Payload))
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	bomb, _ := DeflateCodec{Level: 9}.Compress([]byte{1}, make([]byte, 1<<20))
+	cases := []struct {
+		payload []byte
+		want    error
+	}{
+		{bomb, ErrFrameTooLarge},
+		{[]byte{200, 'x'}, ErrCompression},
+		{[]byte{1, 0xff, 0xff}, ErrCompression},
+	}
+	for _, tc := range cases {
+		e := getEncoder()
+		e.data(ctrlCompress, 1, tc.payload)
+		c1, c2 := net.Pipe()
+		go e.writeTo(c1)
+		receiver := NewConnWithOptions(&c2, ConnOptions{Limits: Limits{MaxMessageSize: 1 << 16}})
+		if _, _, err := receiver.Receive(); !errors.Is(err, tc.want) {
+			t.Errorf("% x: err %v, want %v", tc.payload[:2], err, tc.want)
+		}
+		c1.Close()
+		c2.Close()
+		putEncoder(e)
+	}
+}
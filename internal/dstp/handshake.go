@@ -0,0 +1,304 @@
+package dstp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion 本端实现的协议版本
+const ProtocolVersion uint8 = 1
+
+// 能够互通的最低协议版本
+const minProtocolVersion uint8 = 1
+
+// 等待 HELLO-ACK 期间重发 HELLO 的间隔
+const helloRetryInterval = time.Second
+
+// Capabilities 握手时交换的能力位
+type Capabilities uint32
+
+const (
+	CapChecksum    Capabilities = 1 << iota // CRC32C 校验和
+	CapCompression                          // 数据压缩
+	CapFlowControl                          // 基于信用的流量控制
+	CapStreams                              // 流头和大消息分块
+)
+
+func (c Capabilities) Has(cap Capabilities) bool {
+	return c&cap == cap
+}
+
+// HandshakeOptions 握手时本端声明的能力
+type HandshakeOptions struct {
+	Capabilities Capabilities // 本端支持并愿意使用的能力
+	Required     Capabilities // 对方必须支持的能力，否则拒绝连接
+}
+
+// Features 握手协商出的连接特性
+type Features struct {
+	Version           uint8         // 双方都支持的协议版本
+	Capabilities      Capabilities  // 双方都支持的能力
+	MaxMessageSize    int           // 对方接受的单条消息最大长度，0 表示不限制
+	KeepaliveInterval time.Duration // 对方的 keepalive 间隔，0 表示对方没有启用
+	ReceiveStreams    []uint16      // 对方按流接收的流，这些流上边读边发的消息不受 MaxMessageSize 限制
+}
+
+// 扩展数据包的类型，放在数据的第一个字节
+const (
+	extHello    byte = 1
+	extHelloAck byte = 2
+	extWindow   byte = 3
+	extClose    byte = 4
+	// 按流接收的消息的分块信用，见 streamCreditParts
+	extStreamCredit byte = 5
+)
+
+// HELLO-ACK 的状态
+const (
+	helloOk          byte = 0
+	helloBadVersion  byte = 1
+	helloMissingCaps byte = 2
+)
+
+// hello 数据: |版本|能力位(4)|要求的能力位(4)|最大消息长度(4)|keepalive间隔毫秒(4)|允许的最大消息id(4)|流数量(2)|流id(2)...|
+// 允许的最大消息id是初始的接收窗口，0 表示不限制，之后是按流接收的流，旧版本没有这些字段
+// HELLO-ACK 在前面加 1 字节状态
+type hello struct {
+	version        uint8
+	capabilities   Capabilities
+	required       Capabilities
+	maxMessageSize uint32
+	keepaliveMs    uint32
+	window         uint32
+	receiveStreams []uint16
+}
+
+const helloLen = 1 + 4 + 4 + 4 + 4
+
+func (h hello) append(buf []byte) []byte {
+	buf = append(buf, h.version)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.capabilities))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.required))
+	buf = binary.BigEndian.AppendUint32(buf, h.maxMessageSize)
+	buf = binary.BigEndian.AppendUint32(buf, h.keepaliveMs)
+	buf = binary.BigEndian.AppendUint32(buf, h.window)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.receiveStreams)))
+	for _, stream := range h.receiveStreams {
+		buf = binary.BigEndian.AppendUint16(buf, stream)
+	}
+	return buf
+}
+
+func parseHello(data []byte) (hello, error) {
+	// 新版本可能在后面追加字段，只要求长度不小于 helloLen
+	if len(data) < helloLen {
+		return hello{}, fmt.Errorf("%w: short hello", ErrHandshake)
+	}
+	h := hello{
+		version:        data[0],
+		capabilities:   Capabilities(binary.BigEndian.Uint32(data[1:])),
+		required:       Capabilities(binary.BigEndian.Uint32(data[5:])),
+		maxMessageSize: binary.BigEndian.Uint32(data[9:]),
+		keepaliveMs:    binary.BigEndian.Uint32(data[13:]),
+	}
+	if len(data) >= helloLen+4 {
+		h.window = binary.BigEndian.Uint32(data[helloLen:])
+	}
+	if rest := data[min(len(data), helloLen+4):]; len(rest) >= 2 {
+		n := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+2*n {
+			return hello{}, fmt.Errorf("%w: short stream list", ErrHandshake)
+		}
+		for i := range n {
+			h.receiveStreams = append(h.receiveStreams, binary.BigEndian.Uint16(rest[2+2*i:]))
+		}
+	}
+	return h, nil
+}
+
+// localHello 按连接选项生成本端的 hello
+func (c *Conn) localHello() hello {
+	return hello{
+		version:        ProtocolVersion,
+		capabilities:   c.opts.Handshake.Capabilities,
+		required:       c.opts.Handshake.Required,
+		maxMessageSize: uint32(max(c.opts.Limits.MaxMessageSize, 0)),
+		keepaliveMs:    uint32(c.opts.Keepalive.Interval.Milliseconds()),
+		window:         c.initialWindow(),
+		receiveStreams: c.opts.ReceiveStreams,
+	}
+}
+
+// negotiate 检查对方是否兼容，返回协商结果和 HELLO-ACK 状态
+func (c *Conn) negotiate(peer hello) (Features, byte, error) {
+	local := c.localHello()
+	if peer.version < minProtocolVersion {
+		return Features{}, helloBadVersion, fmt.Errorf("%w: peer version %d, need at least %d",
+			ErrIncompatiblePeer, peer.version, minProtocolVersion)
+	}
+	if missing := peer.required &^ local.capabilities; missing != 0 {
+		return Features{}, helloMissingCaps, fmt.Errorf("%w: peer requires capabilities %#x",
+			ErrIncompatiblePeer, uint32(missing))
+	}
+	if missing := local.required &^ peer.capabilities; missing != 0 {
+		return Features{}, helloMissingCaps, fmt.Errorf("%w: peer lacks capabilities %#x",
+			ErrIncompatiblePeer, uint32(missing))
+	}
+	return Features{
+		Version:           min(peer.version, local.version),
+		Capabilities:      peer.capabilities & local.capabilities,
+		MaxMessageSize:    int(peer.maxMessageSize),
+		KeepaliveInterval: time.Duration(peer.keepaliveMs) * time.Millisecond,
+		ReceiveStreams:    peer.receiveStreams,
+	}, helloOk, nil
+}
+
+// applyFeatures 启用协商出的特性
+func (c *Conn) applyFeatures(features Features, peer hello) {
+	c.checksum.Store(features.Capabilities.Has(CapChecksum))
+	if features.Capabilities.Has(CapFlowControl) {
+		c.enableFlowControl(peer.window)
+	}
+	c.features.Store(&features)
+}
+
+// handleExt 处理扩展数据包，数据的第一个字节为扩展类型
+func (c *Conn) handleExt(f *Frame) error {
+	if len(f.Payload) == 0 {
+		return fmt.Errorf("%w: empty extension frame", ErrHandshake)
+	}
+	switch f.Payload[0] {
+	case extHello:
+		return c.onHello(f.Payload[1:])
+	case extHelloAck:
+		return c.onHelloAck(f.Payload[1:])
+	case extWindow:
+		return c.onWindow(f.Payload[1:])
+	case extClose:
+		return c.onClose(f.Payload[1:])
+	case extStreamCredit:
+		return c.onStreamCredit(f.Payload[1:])
+	}
+	// 不认识的扩展类型留给以后的版本，直接忽略
+	return nil
+}
+
+// onHello 对方发起握手，回复 HELLO-ACK，不兼容时回复后关闭连接
+func (c *Conn) onHello(data []byte) error {
+	peer, err := parseHello(data)
+	if err != nil {
+		return err
+	}
+	features, status, negErr := c.negotiate(peer)
+	body := append([]byte{extHelloAck, status}, c.localHello().append(nil)...)
+	if err := c.sendExt(context.Background(), body); err != nil {
+		return err
+	}
+	if negErr != nil {
+		return negErr
+	}
+	c.applyFeatures(features, peer)
+	return nil
+}
+
+// onHelloAck 收到对方对 HELLO 的回复
+func (c *Conn) onHelloAck(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("%w: short hello ack", ErrHandshake)
+	}
+	switch data[0] {
+	case helloOk:
+	case helloBadVersion:
+		return fmt.Errorf("%w: peer rejected version %d", ErrIncompatiblePeer, ProtocolVersion)
+	case helloMissingCaps:
+		return fmt.Errorf("%w: peer rejected capabilities", ErrIncompatiblePeer)
+	default:
+		return fmt.Errorf("%w: peer rejected handshake (status %d)", ErrIncompatiblePeer, data[0])
+	}
+	peer, err := parseHello(data[1:])
+	if err != nil {
+		return err
+	}
+	features, _, err := c.negotiate(peer)
+	if err != nil {
+		return err
+	}
+	c.applyFeatures(features, peer)
+	return nil
+}
+
+// sendExt 发送扩展数据包，不分配消息id
+func (c *Conn) sendExt(ctx context.Context, body []byte) error {
+	e := c.encoder()
+	defer putEncoder(e)
+	e.data(ctrlExt, 0, body)
+	return c.writeFrame(ctx, e, priorityInternal)
+}
+
+// Handshake 发送 HELLO 并等待对方的 HELLO-ACK，协商协议版本和能力
+// 由发起连接的一端在开始接收数据之前调用，接受连接的一端在 Receive 中自动回复
+// 对方不兼容时关闭连接并返回 ErrIncompatiblePeer
+func (c *Conn) Handshake(ctx context.Context) (Features, error) {
+	body := append([]byte{extHello}, c.localHello().append(nil)...)
+	if err := c.sendExt(ctx, body); err != nil {
+		return Features{}, err
+	}
+	// 不可靠的传输层上 HELLO 或 HELLO-ACK 可能丢失，等待期间定期重发
+	if c.lossy() {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			ticker := time.NewTicker(helloRetryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				if c.sendExt(ctx, body) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var f Frame
+	for {
+		if err := c.receiveContext(ctx, &f); err != nil {
+			return Features{}, err
+		}
+		switch f.Type {
+		case FramePing, FramePong, FrameAck:
+			continue
+		case frameExt:
+			if features, ok := c.Features(); ok {
+				return features, nil
+			}
+		default:
+			c.closeWithError(ErrHandshake)
+			return Features{}, fmt.Errorf("%w: %v frame before HELLO-ACK", ErrHandshake, f.Type)
+		}
+	}
+}
+
+// lossyConn 由可能丢失数据包的传输层实现，TCP、TLS 和 WebSocket 不会丢失数据包
+type lossyConn interface {
+	lossy() bool
+}
+
+// lossy 判断底层连接是否可能丢失数据包
+func (c *Conn) lossy() bool {
+	l, ok := (*c.conn).(lossyConn)
+	return ok && l.lossy()
+}
+
+// Features 返回握手协商出的特性，还没有完成握手时 ok 为 false
+func (c *Conn) Features() (features Features, ok bool) {
+	if f := c.features.Load(); f != nil {
+		return *f, true
+	}
+	return Features{}, false
+}
@@ -0,0 +1,42 @@
+package dstp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// KeepaliveOptions DSTP 层心跳
+type KeepaliveOptions struct {
+	Interval  time.Duration // 发送 ping 的间隔，0 表示不启用
+	MaxMissed int           // 连续这么多个周期没有收到 pong 则认为对方已断开，0 按 3 处理
+}
+
+// keepalive 定期发送 ping，对方长时间没有 pong 时关闭连接
+// pong 由 Receive 处理，启用时需要有协程持续接收数据
+func (c *Conn) keepalive(opts KeepaliveOptions) {
+	maxMissed := opts.MaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 3
+	}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if c.rtt.tick() >= maxMissed {
+			c.closeWithError(ErrPeerDead)
+			return
+		}
+		// 写锁被卡住的发送占用或对方不再读取时 ping 写不出去，超时后算作这个周期没有收到 pong
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Interval)
+		err := c.sendPing(ctx)
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+	}
+}
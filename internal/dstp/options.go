@@ -0,0 +1,99 @@
+package dstp
+
+import "time"
+
+// RetryPolicy 需要应答的消息的重传策略
+type RetryPolicy struct {
+	MaxRetries int           // 最大重传次数
+	Backoff    time.Duration // 首次发送后等待应答的时间
+	MaxBackoff time.Duration // 等待时间上限，0 表示不限制
+	Multiplier float64       // 每次重传后等待时间的倍数，小于 1 按 1 处理
+	Timeout    time.Duration // 从首次发送起等待应答的总时长，0 表示不限制
+}
+
+// DefaultRetryPolicy 默认重传 3 次，等待时间从 1 秒开始翻倍，最长 10 秒
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		Backoff:    time.Second,
+		MaxBackoff: 10 * time.Second,
+		Multiplier: 2,
+	}
+}
+
+// next 返回下一次重传前的等待时间
+func (p RetryPolicy) next(backoff time.Duration) time.Duration {
+	if p.Multiplier > 1 {
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// Limits 接收数据时的限制，防止对端让本端无限制地分配内存或占用连接
+type Limits struct {
+	MaxMessageSize int           // 单条消息所有分段合计的最大长度，0 表示不限制
+	MaxSegments    int           // 单条消息的最大分段数，0 表示不限制
+	HeaderTimeout  time.Duration // 收到开始标记后读完头部的最长时间，0 表示不限制
+}
+
+// DefaultLimits 默认单条消息最大 64MiB、1024 个分段，不限制头部读取时间
+func DefaultLimits() Limits {
+	return Limits{
+		MaxMessageSize: 64 << 20,
+		MaxSegments:    1024,
+	}
+}
+
+// ConnOptions 连接选项
+type ConnOptions struct {
+	Retry     RetryPolicy
+	Keepalive KeepaliveOptions
+	Limits    Limits
+	// Resync 为 true 时遇到损坏的数据包不报错，而是跳到下一个开始标记继续接收
+	// 并以 FrameCorrupted 报告，适合会出现误码的传输层
+	Resync bool
+	// Checksum 为 true 时发送的数据包都带 CRC32C 校验和
+	// 接收时按控制标记校验，不影响接收不带校验和的数据包
+	Checksum bool
+	// Handshake 握手时声明的能力，协商后按双方都支持的能力工作
+	Handshake HandshakeOptions
+	// Compression 发送时的压缩选项，握手后只在对方支持压缩时生效
+	Compression CompressionOptions
+	// FlowControl 接收窗口，握手后只在对方支持流量控制时生效
+	FlowControl FlowControlOptions
+	// ReceiveStreams 这些流上的消息不在内存中拼接，收到第一个分块时以 FrameStream 交付
+	// 只能通过 ReceiveFrame 接收，流 0 不能按流接收
+	ReceiveStreams []uint16
+	// Tracer 不为 nil 时接收每个数据包的收发、重传和应答事件
+	Tracer Tracer
+}
+
+// DefaultConnOptions 返回 NewConn 使用的默认选项
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		Retry:  DefaultRetryPolicy(),
+		Limits: DefaultLimits(),
+		Handshake: HandshakeOptions{
+			Capabilities: CapChecksum | CapCompression | CapFlowControl | CapStreams,
+		},
+		FlowControl: FlowControlOptions{Window: 256},
+	}
+}
+
+// SendOptions 单条消息的发送选项
+type SendOptions struct {
+	NeedAck bool
+	Retry   *RetryPolicy // 为 nil 时使用连接的重传策略
+	// NonBlocking 为 true 时对方的接收窗口用完后不等待，返回 ErrWouldBlock
+	NonBlocking bool
+	// Stream 消息所在的流，同一个流上的消息按发送顺序到达，对方不支持流时忽略
+	// 需要插队的消息应使用与大块数据不同的流
+	Stream uint16
+	// Priority 发送优先级，优先级高的消息在其他消息的分块之间写出
+	Priority Priority
+	// OnResult 在收到应答(err 为 nil)或放弃重传时调用，只在 NeedAck 为 true 时生效
+	OnResult func(messageId uint32, err error)
+}
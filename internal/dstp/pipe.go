@@ -0,0 +1,174 @@
+package dstp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// 被推迟的数据包在没有后续数据包时最多再等待的时间
+const pipeReorderWait = 10 * time.Millisecond
+
+// PipeOptions 内存管道在每个方向上注入的传输故障，零值表示不注入
+// Conn 每个数据包只调用一次 Write，故障以整个数据包为单位，丢包和乱序不会破坏帧边界
+type PipeOptions struct {
+	Latency time.Duration // 每个数据包的单向延迟
+	Loss    float64       // 丢弃数据包的概率
+	Reorder float64       // 数据包被推迟到下一个数据包之后送达的概率
+	// Seed 随机数种子，种子和每个方向上的写入顺序相同时丢包和乱序的结果相同
+	Seed int64
+}
+
+// pipePacket 等待送达的数据包
+type pipePacket struct {
+	at   time.Time // 最早的送达时间
+	data []byte
+}
+
+// pipeConn 在 net.Pipe 的一端前面加上发送队列
+// Write 把数据包放入队列后立即返回，和套接字的发送缓冲区一样不等待对方读取
+// forward 协程按送达时间把数据包写入 net.Pipe，读取直接使用 net.Pipe
+type pipeConn struct {
+	net.Conn
+	opts  PipeOptions
+	rnd   *rand.Rand
+	mtx   sync.Mutex
+	queue []pipePacket  // 按送达时间排列
+	held  *pipePacket   // 被推迟到下一个数据包之后的数据包
+	wake  chan struct{} // 队列变化时通知 forward
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeConn(conn net.Conn, opts PipeOptions, seed int64) *pipeConn {
+	c := &pipeConn{
+		Conn: conn,
+		opts: opts,
+		rnd:  rand.New(rand.NewSource(seed)),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go c.forward()
+	return c
+}
+
+// lossy 注入丢包时可能丢失数据包
+func (c *pipeConn) lossy() bool { return c.opts.Loss > 0 }
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// 只在启用对应故障时取随机数，丢包的结果不受乱序设置影响
+	if c.opts.Loss > 0 && c.rnd.Float64() < c.opts.Loss {
+		return len(p), nil
+	}
+	packet := pipePacket{at: time.Now().Add(c.opts.Latency), data: bytes.Clone(p)}
+	if c.held == nil && c.opts.Reorder > 0 && c.rnd.Float64() < c.opts.Reorder {
+		c.held = &packet
+		c.notify()
+		return len(p), nil
+	}
+	c.queue = append(c.queue, packet)
+	if c.held != nil {
+		c.held.at = packet.at
+		c.queue = append(c.queue, *c.held)
+		c.held = nil
+	}
+	c.notify()
+	return len(p), nil
+}
+
+func (c *pipeConn) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next 取出已经到送达时间的数据包，没有时返回需要等待的时间，-1 表示等待新的数据包
+func (c *pipeConn) next(now time.Time) ([]byte, time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.queue) == 0 && c.held != nil {
+		// 后面没有数据包，推迟的数据包等待一段时间后单独送达
+		if wait := c.held.at.Add(pipeReorderWait).Sub(now); wait > 0 {
+			return nil, wait
+		}
+		c.queue = append(c.queue, *c.held)
+		c.held = nil
+	}
+	if len(c.queue) == 0 {
+		return nil, -1
+	}
+	if wait := c.queue[0].at.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	data := c.queue[0].data
+	c.queue[0] = pipePacket{}
+	c.queue = c.queue[1:]
+	return data, 0
+}
+
+func (c *pipeConn) forward() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		data, wait := c.next(time.Now())
+		if data != nil {
+			// 对方关闭后写入返回错误，剩下的数据包不再送达
+			if _, err := c.Conn.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+		var expired <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			expired = timer.C
+		}
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		case <-expired:
+		}
+	}
+}
+
+// Close 关闭本端，还没有送达的数据包被丢弃，对方读到 io.EOF
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// 写入不会阻塞，写截止时间没有意义
+func (c *pipeConn) SetDeadline(t time.Time) error { return c.Conn.SetReadDeadline(t) }
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// PipeConn 返回一对相互连接的内存 net.Conn，两个方向分别按 opts 注入故障
+// 用于需要自己包装 Conn 的场景，例如把连接交给 hub
+func PipeConn(opts PipeOptions) (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	return newPipeConn(a, opts, opts.Seed), newPipeConn(b, opts, opts.Seed+1)
+}
+
+// Pipe 返回两个使用默认选项、相互连接的内存 Conn，不注入故障
+func Pipe() (*Conn, *Conn) {
+	return PipeWithOptions(PipeOptions{}, DefaultConnOptions())
+}
+
+// PipeWithOptions 返回两个相互连接的内存 Conn，不需要监听端口，适合在测试中使用
+// 注入丢包时需要应答的消息依靠重传送达，不需要应答的消息会丢失
+func PipeWithOptions(pipeOpts PipeOptions, opts ConnOptions) (*Conn, *Conn) {
+	a, b := PipeConn(pipeOpts)
+	return NewConnWithOptions(&a, opts), NewConnWithOptions(&b, opts)
+}
@@ -0,0 +1,144 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// 写入不等待对方读取，同一个协程里先发后收不会阻塞
+	if err := a.Send([]byte("hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	data, type_, err := b.Receive()
+	if err != nil || type_ != FrameMessage || string(data) != "hello" {
+		t.Fatalf("got %q %v, %v", data, type_, err)
+	}
+
+	go func() {
+		for {
+			if _, _, err := b.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := a.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pipeDelivery 逐个写入 0..n-1，返回对方按顺序收到的值
+func pipeDelivery(t *testing.T, opts PipeOptions, n int) []byte {
+	t.Helper()
+	a, b := PipeConn(opts)
+	defer a.Close()
+	defer b.Close()
+	for i := 0; i < n; i++ {
+		a.Write([]byte{byte(i)})
+	}
+	var got []byte
+	buf := make([]byte, 16)
+	for {
+		b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := b.Read(buf)
+		if err != nil {
+			return got
+		}
+		got = append(got, buf[:n]...)
+	}
+}
+
+func TestPipeDeterministic(t *testing.T) {
+	opts := PipeOptions{Loss: 0.2, Reorder: 0.2, Seed: 7}
+	first := pipeDelivery(t, opts, 50)
+	second := pipeDelivery(t, opts, 50)
+	if !bytes.Equal(first, second) {
+		t.Fatalf("same seed delivered differently:\n%v\n%v", first, second)
+	}
+	if len(first) == 50 {
+		t.Fatal("no packet lost")
+	}
+	reordered := false
+	for i := 1; i < len(first); i++ {
+		if first[i] < first[i-1] {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Fatalf("no packet reordered: %v", first)
+	}
+}
+
+func TestPipeLatency(t *testing.T) {
+	a, b := PipeWithOptions(PipeOptions{Latency: 50 * time.Millisecond}, DefaultConnOptions())
+	defer a.Close()
+	defer b.Close()
+	start := time.Now()
+	a.Send([]byte("late"), false)
+	if _, _, err := b.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("delivered after %v", elapsed)
+	}
+}
+
+func TestPipeRetransmit(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 20, Backoff: 20 * time.Millisecond}
+	sender, receiver := PipeWithOptions(PipeOptions{Loss: 0.3, Reorder: 0.3, Seed: 1}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 丢失和乱序的消息经过重传全部送达且只交付一次
+	const n = 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- sender.Send([]byte{byte(i)}, true) }()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acked := make(map[byte]int)
+	for len(acked) < n {
+		data, type_, err := receiver.ReceiveContext(ctx)
+		if err != nil {
+			t.Fatalf("received %d of %d: %v", len(acked), n, err)
+		}
+		if type_ == FrameMessage {
+			acked[data[0]]++
+		}
+	}
+	for id, count := range acked {
+		if count != 1 {
+			t.Fatalf("message %d delivered %d times", id, count)
+		}
+	}
+	// 继续接收，让最后的应答和重传完成
+	go func() {
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
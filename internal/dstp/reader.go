@@ -0,0 +1,261 @@
+package dstp
+
+import (
+	"context"
+	"io"
+	"math"
+	"slices"
+	"sync"
+)
+
+// StreamBulk SendStream 使用的流，与普通消息和控制消息分开，不会阻塞其他流上的消息
+const StreamBulk uint16 = math.MaxUint16
+
+// SendStream 在 StreamBulk 上以 PriorityBulk 发送 r 中的数据，见 SendReader
+// 对方把 StreamBulk 加入 ReceiveStreams 时可以边收边读，不需要缓存整条消息，也不受对方 MaxMessageSize 限制
+// 对方的信用在 Receive 中处理，发送较大的数据时需要有协程在接收
+func (c *Conn) SendStream(r io.Reader) error {
+	_, err := c.SendReader(context.Background(), r, SendOptions{Stream: StreamBulk, Priority: PriorityBulk})
+	return err
+}
+
+// StreamReader 按流接收的一条消息，由接收协程逐个分块写入
+// 接收协程不等待应用读取，没有读出的分块缓存在内存中，超过 MaxMessageSize 时消息以 ErrStreamOverflow 中断
+// 协商出流量控制时按读出的分块给发送方信用，发送方随应用的读取放慢
+// 应用需要在接收协程之外读取，不再读取时应调用 Close
+type StreamReader struct {
+	mtx      sync.Mutex
+	parts    [][]byte
+	buffered int // parts 中的字节数
+	limit    int
+	ready    chan struct{} // 写入分块后通知 Read
+	cur      []byte
+	end      chan struct{} // 最后一个分块写入或消息中断后关闭，err 在关闭前设置
+	err      error
+	closed   chan struct{} // 应用调用 Close 后关闭
+	once     sync.Once
+	connDone <-chan struct{}
+	credit   func(parts uint32) // 不为 nil 时读出分块后向发送方通告信用
+	read     uint32             // 已经读出的分块数
+	granted  uint32             // 已经给出的信用
+}
+
+func newStreamReader(connDone <-chan struct{}, limit int) *StreamReader {
+	return &StreamReader{
+		limit:    limit,
+		ready:    make(chan struct{}, 1),
+		end:      make(chan struct{}),
+		closed:   make(chan struct{}),
+		connDone: connDone,
+	}
+}
+
+// Read 读取消息内容，消息完整结束时返回 io.EOF
+// 缺少分块时返回 ErrStreamBroken，读取太慢时返回 ErrStreamOverflow，连接关闭时返回 ErrClosed
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.next() {
+			continue
+		}
+		select {
+		case <-r.ready:
+		case <-r.end:
+			if r.next() {
+				continue
+			}
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		case <-r.connDone:
+			if r.next() {
+				continue
+			}
+			return 0, ErrClosed
+		case <-r.closed:
+			return 0, ErrClosed
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// next 取出下一个缓存的分块，没有时返回 false
+// 信用用掉一半以上且消息还没有收完时给发送方新的信用
+func (r *StreamReader) next() bool {
+	r.mtx.Lock()
+	if len(r.parts) == 0 {
+		r.mtx.Unlock()
+		return false
+	}
+	r.cur = r.parts[0]
+	r.parts[0] = nil
+	r.parts = r.parts[1:]
+	r.buffered -= len(r.cur)
+	r.read++
+	grant := uint32(0)
+	if r.credit != nil && r.granted-r.read < streamCreditParts/2 && !r.ended() {
+		r.granted = r.read + streamCreditParts
+		grant = r.granted
+	}
+	r.mtx.Unlock()
+	if grant != 0 {
+		r.credit(grant)
+	}
+	return true
+}
+
+// ended 判断最后一个分块是否已经写入或消息已经中断
+func (r *StreamReader) ended() bool {
+	select {
+	case <-r.end:
+		return true
+	default:
+		return false
+	}
+}
+
+// credited 返回已经给出的信用
+func (r *StreamReader) credited() uint32 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.granted
+}
+
+// Close 不再读取，之后收到的分块被丢弃
+// 不再限制发送方，等待信用的发送方下次查询时尽快发完剩余的分块
+func (r *StreamReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.mtx.Lock()
+		r.granted = maxParts
+		r.mtx.Unlock()
+	})
+	return nil
+}
+
+// push 写入一个分块，不等待应用读取，应用关闭后丢弃
+// 缓存的数据超过上限时返回 false，调用方以 ErrStreamOverflow 结束消息
+func (r *StreamReader) push(data []byte) bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+	}
+	r.mtx.Lock()
+	if r.limit > 0 && r.buffered+len(data) > r.limit {
+		r.mtx.Unlock()
+		return false
+	}
+	r.parts = append(r.parts, slices.Clone(data))
+	r.buffered += len(data)
+	r.mtx.Unlock()
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// finish 结束消息，err 为 nil 表示消息完整
+func (r *StreamReader) finish(err error) {
+	r.err = err
+	close(r.end)
+}
+
+// inboundStream 流上正在接收的消息，r 为 nil 时丢弃之后的分块，只在结束时应答
+type inboundStream struct {
+	id    uint32
+	next  uint16
+	fresh bool // 第一个分块到达时消息id没有接收过，消息已经交付；否则是已经接收过的重传
+	r     *StreamReader
+}
+
+// streamed 判断数据包是否按流接收，压缩的消息需要整条解压，仍然拼接后交付
+func (c *Conn) streamed(f *Frame) bool {
+	return f.Flags&ctrlStream == ctrlStream && f.Flags&ctrlCompress == 0 &&
+		f.Stream != 0 && slices.Contains(c.opts.ReceiveStreams, f.Stream)
+}
+
+// receivePart 处理按流接收的分块，消息的第一个分块以 FrameStream 交付时返回 true
+// 分块丢失或乱序时以 ErrStreamBroken 结束正在读取的消息
+// 需要应答的消息在最后一个分块到达后应答，中断的消息由发送方整条重传，作为新的 FrameStream 交付
+func (c *Conn) receivePart(f *Frame) (bool, error) {
+	in := c.inbound[f.Stream]
+	if f.aborted {
+		// 发送方中途放弃，正在读取的消息不完整
+		if in != nil && in.id == f.Id {
+			if in.r != nil {
+				in.r.finish(ErrStreamBroken)
+			}
+			delete(c.inbound, f.Stream)
+		}
+		return false, nil
+	}
+	if f.part == 0 {
+		if in != nil && in.r != nil {
+			in.r.finish(ErrStreamBroken)
+		}
+		in = &inboundStream{id: f.Id, fresh: !c.recvSeq.seen(f.Id)}
+		if in.fresh {
+			in.r = newStreamReader(c.done, c.opts.Limits.MaxMessageSize)
+			if c.peerHas(CapFlowControl) {
+				stream, id := f.Stream, f.Id
+				in.r.granted = streamCreditParts
+				in.r.credit = func(parts uint32) { c.sendStreamCredit(stream, id, parts) }
+			}
+		}
+		c.inbound[f.Stream] = in
+	} else if in == nil || in.id != f.Id || in.next != f.part {
+		if in != nil && in.r != nil {
+			in.r.finish(ErrStreamBroken)
+		}
+		delete(c.inbound, f.Stream)
+		return false, nil
+	}
+	in.next++
+
+	r := in.r
+	if in.r != nil && !in.r.push(f.Payload) {
+		// 应用读取太慢，中断这条消息，不让接收协程等待
+		in.r.finish(ErrStreamOverflow)
+		in.r = nil
+	}
+	if f.last {
+		delete(c.inbound, f.Stream)
+		if in.r != nil {
+			in.r.finish(nil)
+		}
+		if err := c.completeStream(f, in.fresh); err != nil {
+			return false, err
+		}
+	}
+	if f.part != 0 || !in.fresh {
+		return false, nil
+	}
+	f.Type = FrameStream
+	f.Reader = r
+	f.Payload = f.Payload[:0]
+	return true, nil
+}
+
+// completeStream 按流接收的消息结束，记录消息id并在需要时应答
+// fresh 为 true 表示第一个分块到达时消息id没有接收过，消息已经交付，不再按去重窗口判断重复
+func (c *Conn) completeStream(f *Frame, fresh bool) error {
+	duplicate := !fresh
+	if fresh {
+		c.recvSeq.record(f.Id)
+	} else {
+		c.recvSeq.observe(f.Id)
+	}
+	if f.Flags&ctrlNeedAck == ctrlNeedAck {
+		if err := c.sendAck(f.Id); err != nil {
+			return err
+		}
+	}
+	if duplicate {
+		return nil
+	}
+	return c.advertiseWindow(false)
+}
@@ -0,0 +1,304 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSendStream(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := handshakePair(t, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 应用在接收协程之外读取，接收协程继续处理之后的消息
+	data := make([]byte, 32*streamPartSize+5)
+	rand.New(rand.NewSource(3)).Read(data)
+	sent := make(chan error, 1)
+	go func() {
+		err := sender.SendStream(bytes.NewReader(data))
+		sender.Send([]byte("after"), false)
+		sent <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var f Frame
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream || f.Stream != StreamBulk || f.Priority != PriorityBulk || f.Reader == nil {
+		t.Fatalf("got %v on stream %d priority %d", f.Type, f.Stream, f.Priority)
+	}
+	read := make(chan []byte, 1)
+	go func(r io.Reader) {
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- got
+	}(f.Reader)
+
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || string(f.Payload) != "after" {
+		t.Fatalf("got %v %q", f.Type, f.Payload)
+	}
+	if got := <-read; !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamReaderBroken(t *testing.T) {
+	s := streamInfo{stream: 2}
+	var raw []byte
+	for _, part := range []uint16{0, 2} {
+		e := getEncoder()
+		e.streamData(0, 1, s, part, false, []byte{byte('a' + part)})
+		raw = append(raw, e.buf...)
+		putEncoder(e)
+	}
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{2}
+	conn := newReaderConn(raw)
+	receiver := NewConnWithOptions(&conn, opts)
+
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream {
+		t.Fatalf("got %v", f.Type)
+	}
+	// 第二个分块丢失，读出已收到的数据后报告消息不完整
+	if err := receiver.ReceiveFrame(context.Background(), &Frame{}); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	got, err := io.ReadAll(f.Reader)
+	if string(got) != "a" || !errors.Is(err, ErrStreamBroken) {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestSendStreamAbort(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := handshakePair(t, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 发送方读取出错时通知对方放弃，正在读取的消息立即以 ErrStreamBroken 结束
+	errRead := errors.New("read failed")
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sender.SendStream(io.MultiReader(bytes.NewReader(make([]byte, 3*streamPartSize)), iotest.ErrReader(errRead)))
+	}()
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream {
+		t.Fatalf("got %v", f.Type)
+	}
+	r := f.Reader
+	go func() {
+		for receiver.ReceiveFrame(context.Background(), &f) == nil {
+		}
+	}()
+	if err := <-sent; !errors.Is(err, errRead) {
+		t.Fatalf("got %v, want %v", err, errRead)
+	}
+	read := make(chan error, 1)
+	go func() {
+		got, err := io.ReadAll(r)
+		if len(got) == 0 || len(got)%streamPartSize != 0 {
+			t.Errorf("read %d bytes", len(got))
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if !errors.Is(err, ErrStreamBroken) {
+			t.Fatalf("got %v, want ErrStreamBroken", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader still waiting after the sender gave up")
+	}
+}
+
+func TestStreamReaderClose(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := handshakePair(t, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go func() {
+		sender.SendStream(bytes.NewReader(make([]byte, 32*streamPartSize)))
+		sender.Send([]byte("after"), false)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var f Frame
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream {
+		t.Fatalf("got %v", f.Type)
+	}
+	// 应用不再读取后剩余的分块被丢弃
+	f.Reader.Close()
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || string(f.Payload) != "after" {
+		t.Fatalf("got %v %q", f.Type, f.Payload)
+	}
+}
+
+func TestStreamReaderOverflow(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.Limits.MaxMessageSize = 4 * streamPartSize
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := handshakePair(t, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 对方按流接收，超过 MaxMessageSize 的消息也可以发送
+	sent := make(chan error, 1)
+	go func() {
+		err := sender.SendStream(bytes.NewReader(make([]byte, 8*streamPartSize)))
+		sender.Send([]byte("after"), false)
+		sent <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var f Frame
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream {
+		t.Fatalf("got %v", f.Type)
+	}
+	r := f.Reader
+	// 应用没有读取，接收协程不等待，缓存满后中断这条消息
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || string(f.Payload) != "after" {
+		t.Fatalf("got %v %q", f.Type, f.Payload)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if len(got) != 4*streamPartSize || !errors.Is(err, ErrStreamOverflow) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+
+	// 对方拼接的流仍然受 MaxMessageSize 限制
+	go func() {
+		for receiver.ReceiveFrame(context.Background(), &Frame{}) == nil {
+		}
+	}()
+	_, err = sender.SendReader(ctx, bytes.NewReader(make([]byte, 5*streamPartSize)), SendOptions{Stream: 2})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestSendStreamPlain(t *testing.T) {
+	// 没有握手时不带流头发送，对方按普通消息接收
+	c1, c2 := net.Pipe()
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := NewConn(&c1), NewConnWithOptions(&c2, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go sender.SendStream(bytes.NewReader([]byte("plain")))
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameMessage || string(f.Payload) != "plain" {
+		t.Fatalf("got %v %q", f.Type, f.Payload)
+	}
+}
+
+// countingReader 记录已经被读取的字节数
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestSendStreamCredit(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.ReceiveStreams = []uint16{StreamBulk}
+	sender, receiver := handshakePair(t, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	data := make([]byte, 4*streamCreditParts*streamPartSize)
+	rand.New(rand.NewSource(5)).Read(data)
+	src := &countingReader{r: bytes.NewReader(data)}
+	// 发送方在 Receive 中处理对方的信用
+	go func() {
+		for sender.ReceiveFrame(context.Background(), &Frame{}) == nil {
+		}
+	}()
+	sent := make(chan error, 1)
+	go func() { sent <- sender.SendStream(src) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var f Frame
+	if err := receiver.ReceiveFrame(ctx, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != FrameStream {
+		t.Fatalf("got %v", f.Type)
+	}
+	r := f.Reader
+	go func() {
+		for receiver.ReceiveFrame(context.Background(), &Frame{}) == nil {
+		}
+	}()
+
+	// 应用没有读取，发送方用完初始信用后等待，不会读出全部数据
+	time.Sleep(200 * time.Millisecond)
+	if n := src.n.Load(); n > int64(streamCreditParts+1)*streamPartSize {
+		t.Fatalf("sender read %d bytes without credit", n)
+	}
+	select {
+	case err := <-sent:
+		t.Fatalf("send finished without credit: %v", err)
+	default:
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package dstp
+
+import "sync"
+
+// 去重窗口大小，比最大id早这么多以上的消息一律视为重复
+const seqWindowSize = 1024
+
+// SeqLess 按序列号算术(RFC 1982)比较两个消息id，a 在 b 之前返回 true
+// 消息id回绕后仍能正确比较，只要两者相差不超过 2^31
+func SeqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqTracker 用滑动窗口记录接收到的消息id，检测丢失和重复
+type seqTracker struct {
+	mtx        sync.Mutex
+	started    bool
+	last       uint32
+	window     [seqWindowSize / 64]uint64
+	gaps       uint64
+	duplicates uint64
+}
+
+func (s *seqTracker) slot(id uint32) (int, uint64) {
+	i := id % seqWindowSize
+	return int(i / 64), 1 << (i % 64)
+}
+
+func (s *seqTracker) set(id uint32) {
+	w, m := s.slot(id)
+	s.window[w] |= m
+}
+
+func (s *seqTracker) clear(id uint32) {
+	w, m := s.slot(id)
+	s.window[w] &^= m
+}
+
+func (s *seqTracker) has(id uint32) bool {
+	w, m := s.slot(id)
+	return s.window[w]&m != 0
+}
+
+// observe 记录一个消息id，该id已经接收过(或早于窗口)时返回 true
+func (s *seqTracker) observe(id uint32) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.duplicate(id) {
+		s.duplicates++
+		return true
+	}
+	s.add(id)
+	return false
+}
+
+// record 记录开始接收时确认没有接收过的消息id
+// 分块消息拼接期间可能有超过窗口的新消息先完成，这时消息已经早于窗口，但不是重复
+func (s *seqTracker) record(id uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.duplicate(id) {
+		s.add(id)
+	}
+}
+
+// duplicate 判断消息id是否已经接收过或早于窗口，调用时持有 mtx
+func (s *seqTracker) duplicate(id uint32) bool {
+	if !s.started {
+		return false
+	}
+	diff := int32(id - s.last)
+	return diff <= 0 && (-diff >= seqWindowSize || s.has(id))
+}
+
+// add 记录一个新的消息id，调用时持有 mtx
+func (s *seqTracker) add(id uint32) {
+	if !s.started {
+		s.started = true
+		s.last = id
+		s.set(id)
+		return
+	}
+
+	diff := int32(id - s.last)
+	if diff > 0 {
+		if diff >= seqWindowSize {
+			s.window = [seqWindowSize / 64]uint64{}
+		} else {
+			for i := uint32(1); i < uint32(diff); i++ {
+				s.clear(s.last + i)
+			}
+		}
+		s.gaps += uint64(diff - 1)
+		s.last = id
+		s.set(id)
+		return
+	}
+	// 迟到的消息补上了之前的空缺
+	s.set(id)
+	if s.gaps > 0 {
+		s.gaps--
+	}
+}
+
+// seen 判断消息id是否已经接收过，不记录
+func (s *seqTracker) seen(id uint32) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.duplicate(id)
+}
+
+func (s *seqTracker) snapshot() (last uint32, gaps, duplicates uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.last, s.gaps, s.duplicates
+}
@@ -0,0 +1,165 @@
+package dstp
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats 连接统计信息快照
+type Stats struct {
+	RTT           time.Duration // 最近一次测得的往返时延
+	SmoothedRTT   time.Duration // 平滑往返时延
+	RTTVar        time.Duration // 往返时延抖动
+	PingsSent     uint64
+	PongsReceived uint64
+	MissedPongs   int       // 连续没有收到 pong 的 keepalive 周期数
+	LastPong      time.Time // 最近一次收到 pong 的时间
+
+	CorruptedFrames uint64 // 恢复模式下跳过的损坏数据包数
+	DiscardedBytes  uint64 // 恢复模式下丢弃的字节数
+	ChecksumErrors  uint64 // 校验和不匹配的数据包数
+
+	PendingAcks int    // 已发出、等待应答的消息数
+	SendWindow  int    // 对方窗口内还能发送的消息数，-1 表示对方没有启用流量控制
+	SendWaiting int    // 正在等待对方窗口的发送数
+	SendBlocked uint64 // 因对方窗口用完而等待或返回 ErrWouldBlock 的发送次数
+	RecvWindow  int    // 本端通告的窗口内对方还能发送的消息数，-1 表示没有启用流量控制
+
+	BytesSent          uint64               // 完整写出的数据包的字节数
+	BytesReceived      uint64               // 读到的校验通过的数据包的字节数
+	FramesSent         map[FrameType]uint64 // 按类型统计写出的数据包数，分块和扩展包按线路上的类型计算
+	FramesReceived     map[FrameType]uint64 // 按类型统计读到的数据包数
+	SegmentsSent       uint64
+	SegmentsReceived   uint64
+	Retransmits        uint64        // 重传需要应答的消息的次数
+	AcksReceived       uint64        // 收到应答的消息数，重复的应答不计入
+	AckLatency         time.Duration // 最近一条消息从首次发送到收到应答的时间
+	SmoothedAckLatency time.Duration // 平滑应答延迟
+}
+
+// rttEstimator 按 RFC 6298 的方法估计往返时延
+type rttEstimator struct {
+	mtx         sync.Mutex
+	pingSentAt  time.Time // 最早一个还没有收到 pong 的 ping 的发送时间
+	rtt         time.Duration
+	srtt        time.Duration
+	rttvar      time.Duration
+	pingsSent   uint64
+	pongsRecved uint64
+	missed      int
+	lastPong    time.Time
+}
+
+func (r *rttEstimator) onPing(now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.pingsSent++
+	if r.pingSentAt.IsZero() {
+		r.pingSentAt = now
+	}
+}
+
+func (r *rttEstimator) onPong(now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.pongsRecved++
+	r.lastPong = now
+	r.missed = 0
+	if r.pingSentAt.IsZero() {
+		return
+	}
+	sample := now.Sub(r.pingSentAt)
+	r.pingSentAt = time.Time{}
+	r.rtt = sample
+	if r.srtt == 0 {
+		r.srtt = sample
+		r.rttvar = sample / 2
+		return
+	}
+	diff := r.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	r.rttvar = (3*r.rttvar + diff) / 4
+	r.srtt = (7*r.srtt + sample) / 8
+}
+
+// tick 在每个 keepalive 周期调用，返回连续未收到 pong 的周期数
+func (r *rttEstimator) tick() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.pingSentAt.IsZero() {
+		r.missed++
+	}
+	return r.missed
+}
+
+// latencyEstimator 统计从首次发送到收到应答的时间，平滑方法与 srtt 相同
+type latencyEstimator struct {
+	mtx      sync.Mutex
+	count    uint64
+	last     time.Duration
+	smoothed time.Duration
+}
+
+func (l *latencyEstimator) observe(sample time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.count++
+	l.last = sample
+	if l.smoothed == 0 {
+		l.smoothed = sample
+		return
+	}
+	l.smoothed = (7*l.smoothed + sample) / 8
+}
+
+// Stats 返回连接统计信息快照
+func (c *Conn) Stats() Stats {
+	c.pendingMtx.Lock()
+	pendingAcks := len(c.pending)
+	c.pendingMtx.Unlock()
+	c.sendWin.mtx.Lock()
+	sendWaiting, sendBlocked := c.sendWin.waiting, c.sendWin.blocked
+	c.sendWin.mtx.Unlock()
+
+	l := &c.ackLatency
+	l.mtx.Lock()
+	acks, ackLatency, smoothedAck := l.count, l.last, l.smoothed
+	l.mtx.Unlock()
+	t := &c.traffic
+
+	r := &c.rtt
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return Stats{
+		RTT:           r.rtt,
+		SmoothedRTT:   r.srtt,
+		RTTVar:        r.rttvar,
+		PingsSent:     r.pingsSent,
+		PongsReceived: r.pongsRecved,
+		MissedPongs:   r.missed,
+		LastPong:      r.lastPong,
+
+		CorruptedFrames: c.corruptedFrames.Load(),
+		DiscardedBytes:  c.discardedBytes.Load(),
+		ChecksumErrors:  c.checksumErrors.Load(),
+
+		PendingAcks: pendingAcks,
+		SendWindow:  c.sendWin.remaining(c.LastSentId()),
+		SendWaiting: sendWaiting,
+		SendBlocked: sendBlocked,
+		RecvWindow:  c.recvWin.remaining(c.LastReceivedId()),
+
+		BytesSent:          t.bytesSent.Load(),
+		BytesReceived:      t.bytesRecved.Load(),
+		FramesSent:         t.framesSent.snapshot(),
+		FramesReceived:     t.framesRecved.snapshot(),
+		SegmentsSent:       t.segmentsSent.Load(),
+		SegmentsReceived:   t.segmentsRecved.Load(),
+		Retransmits:        t.retransmits.Load(),
+		AcksReceived:       acks,
+		AckLatency:         ackLatency,
+		SmoothedAckLatency: smoothedAck,
+	}
+}
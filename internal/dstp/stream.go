@@ -0,0 +1,309 @@
+package dstp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+)
+
+// 对方支持流时，超过这个长度的消息拆成多个分块发送，分块之间可以插入优先级更高的数据包
+const streamPartSize = 16 << 10
+
+// 流头长度: |流id(2)|优先级(1)|分块序号(2)|标记(1)|
+const streamHeaderLen = 2 + 1 + 2 + 1
+
+// 流头标记
+const (
+	streamLastPart byte = 0x01 // 这是消息的最后一个分块
+	// 发送方中途放弃了这条消息，分块没有数据，对方丢弃已经收到的分块
+	// 旧版本不认识这个标记，按普通分块处理，消息等到流上的下一条消息时被丢弃
+	streamAborted byte = 0x02
+)
+
+// 一条分块消息最多的分块数，受流头中分块序号的长度限制
+const maxParts = math.MaxUint16 + 1
+
+// Priority 消息的发送优先级，数值越大越先发送
+// 优先级只影响本端写出数据包的顺序，随流头发给对方，供转发消息的一端沿用
+type Priority int8
+
+const (
+	PriorityBulk    Priority = -1 // 大块数据，让出给其他消息
+	PriorityNormal  Priority = 0
+	PriorityControl Priority = 1 // 控制消息，可以在其他消息的分块之间插队
+	// ack、pong 和扩展包使用最高优先级
+	priorityInternal Priority = math.MaxInt8
+)
+
+// streamInfo 消息所在的流和优先级，nil 表示不带流头
+type streamInfo struct {
+	stream   uint16
+	priority Priority
+}
+
+// partCount 返回消息拆成的分块数，不带流头时整条消息是一个数据包
+func partCount(dataLen int, s *streamInfo) int {
+	if s == nil || dataLen == 0 {
+		return 1
+	}
+	return (dataLen + streamPartSize - 1) / streamPartSize
+}
+
+// writeLock 按优先级排队的写锁，同一优先级先到先得
+// 分块的消息每个分块单独获取写锁，优先级更高的数据包在分块之间写出
+type writeLock struct {
+	mtx     sync.Mutex
+	locked  bool
+	waiters []*lockWaiter // 按优先级从高到低排列
+}
+
+type lockWaiter struct {
+	priority Priority
+	ready    chan struct{} // 获得写锁时关闭
+}
+
+// lock 获取写锁，等待期间 ctx 结束则放弃
+func (l *writeLock) lock(ctx context.Context, priority Priority) error {
+	l.mtx.Lock()
+	if !l.locked {
+		l.locked = true
+		l.mtx.Unlock()
+		return nil
+	}
+	w := &lockWaiter{priority: priority, ready: make(chan struct{})}
+	i := 0
+	for i < len(l.waiters) && l.waiters[i].priority >= priority {
+		i++
+	}
+	l.waiters = slices.Insert(l.waiters, i, w)
+	l.mtx.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mtx.Lock()
+	if i := slices.Index(l.waiters, w); i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+		l.mtx.Unlock()
+		return ctx.Err()
+	}
+	l.mtx.Unlock()
+	// 放弃前已经获得了写锁，交给下一个等待者
+	l.unlock()
+	return ctx.Err()
+}
+
+// unlock 释放写锁，有等待者时直接交给优先级最高的一个
+func (l *writeLock) unlock() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.waiters) == 0 {
+		l.locked = false
+		return
+	}
+	w := l.waiters[0]
+	l.waiters = slices.Delete(l.waiters, 0, 1)
+	close(w.ready)
+}
+
+// lockStream 获取流的发送锁，同一个流上的消息依次发送，分块不会交错
+func (c *Conn) lockStream(ctx context.Context, stream uint16) (func(), error) {
+	c.streamMtx.Lock()
+	lock, ok := c.streamLocks[stream]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		c.streamLocks[stream] = lock
+	}
+	c.streamMtx.Unlock()
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// partialMessage 正在拼接的分块消息
+type partialMessage struct {
+	id    uint32
+	next  uint16 // 下一个分块的序号
+	fresh bool   // 第一个分块到达时消息id没有接收过
+	data  []byte
+}
+
+// assemble 拼接带流头的数据包，收到最后一个分块时把整条消息放入 f.Payload 并返回 true
+// fresh 为 true 表示多个分块的消息在第一个分块到达时没有接收过，完成时不再按去重窗口判断重复
+// 分块丢失或乱序时丢弃已拼接的部分，需要应答的消息由发送方整条重传
+func (c *Conn) assemble(f *Frame) (complete, fresh bool, err error) {
+	if f.aborted {
+		if p := c.partials[f.Stream]; p != nil && p.id == f.Id {
+			delete(c.partials, f.Stream)
+		}
+		return false, false, nil
+	}
+	if f.part == 0 && f.last {
+		return true, false, nil
+	}
+	p := c.partials[f.Stream]
+	switch {
+	case f.part == 0:
+		if p == nil {
+			p = &partialMessage{}
+			c.partials[f.Stream] = p
+		}
+		p.id, p.next, p.fresh, p.data = f.Id, 0, !c.recvSeq.seen(f.Id), p.data[:0]
+	case p == nil || p.id != f.Id || p.next != f.part:
+		delete(c.partials, f.Stream)
+		return false, false, nil
+	}
+	if limit := c.opts.Limits.MaxMessageSize; limit > 0 && len(p.data)+len(f.Payload) > limit {
+		delete(c.partials, f.Stream)
+		return false, false, fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, limit)
+	}
+	p.data = append(p.data, f.Payload...)
+	p.next++
+	if !f.last {
+		return false, false, nil
+	}
+	f.Payload = append(f.Payload[:0], p.data...)
+	delete(c.partials, f.Stream)
+	return true, p.fresh, nil
+}
+
+// SendReader 从 r 读取一条消息并发送，返回消息id
+// 对方支持流时按分块边读边发，整条消息不需要放在内存中，r 返回 io.EOF 时消息结束
+// 对方不支持流时读出全部数据后按普通消息发送
+// 边读边发的消息不压缩，需要应答时为了重传会保留已发送的数据
+// 对方按流接收且协商出流量控制时按对方给出的信用发送，对方的应用读得慢时在分块之间等待，信用在 Receive 中处理
+// r 返回其他错误时消息没有发完，对方在这个流收到下一条消息时丢弃已拼接的部分
+func (c *Conn) SendReader(ctx context.Context, r io.Reader, opts SendOptions) (uint32, error) {
+	if !c.peerHas(CapStreams) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return c.sendData(ctx, data, opts)
+	}
+	if c.closing.Load() {
+		return 0, ErrClosed
+	}
+	unlock, err := c.lockStream(ctx, opts.Stream)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	// 在读取数据之前确认窗口，非阻塞发送返回 ErrWouldBlock 时 r 没有被读取
+	if err := c.waitWindow(ctx, opts.NonBlocking); err != nil {
+		return 0, err
+	}
+
+	// 对方按流接收时不拼接整条消息，不受对方的消息长度限制，协商出流量控制时按对方给出的信用发送
+	f := c.features.Load()
+	limit, credited := f.MaxMessageSize, false
+	if slices.Contains(f.ReceiveStreams, opts.Stream) {
+		limit, credited = 0, f.Capabilities.Has(CapFlowControl)
+	}
+	var ctrl byte
+	if opts.NeedAck {
+		ctrl |= ctrlNeedAck
+	}
+	s := &streamInfo{stream: opts.Stream, priority: opts.Priority}
+	var p *pendingAck
+	if opts.NeedAck {
+		p = newPendingAck(ctrl, nil, s, opts.Priority, c.retryPolicy(opts), opts.OnResult)
+	}
+
+	br := bufio.NewReaderSize(r, streamPartSize)
+	buf := make([]byte, streamPartSize)
+	var messageId uint32
+	size := 0
+	for part := 0; ; part++ {
+		var n int
+		var last bool
+		var err error
+		if credited {
+			err = c.waitStreamCredit(ctx, opts.Stream, messageId, part)
+		}
+		if err == nil {
+			n, last, err = readPart(br, buf)
+		}
+		size += n
+		if err == nil && limit > 0 && size > limit {
+			err = fmt.Errorf("%w: peer accepts at most %d bytes", ErrFrameTooLarge, limit)
+		}
+		if err == nil && part >= maxParts {
+			err = fmt.Errorf("%w: more than %d parts", ErrFrameTooLarge, maxParts)
+		}
+		if err == nil {
+			e := c.encoder()
+			e.streamData(ctrl, messageId, *s, uint16(part), last, buf[:n])
+			if part == 0 {
+				messageId, err = c.writeData(ctx, e, p, opts.Priority, opts.NonBlocking)
+			} else {
+				err = c.writeFrame(ctx, e, opts.Priority)
+			}
+			putEncoder(e)
+		}
+		if err != nil {
+			if part > 0 {
+				if p != nil {
+					c.dropPending(messageId)
+				}
+				c.abortStream(ctx, ctrl, messageId, s, part)
+			}
+			return 0, err
+		}
+		if p != nil {
+			p.data = append(p.data, buf[:n]...)
+		}
+		if last {
+			break
+		}
+	}
+	if p != nil {
+		go c.retransmit(messageId, p)
+	}
+	return messageId, nil
+}
+
+// abortStream 通知对方放弃已经写出部分分块的消息，对方按流接收时以 ErrStreamBroken 结束读取
+// ctx 已经结束时在很短的时间内尽量写出
+func (c *Conn) abortStream(ctx context.Context, ctrl byte, messageId uint32, s *streamInfo, part int) {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), closeWriteTimeout)
+		defer cancel()
+	}
+	e := c.encoder()
+	defer putEncoder(e)
+	e.abortStream(ctrl, messageId, *s, uint16(part))
+	c.writeFrame(ctx, e, s.priority)
+}
+
+// readPart 读满一个分块，last 表示 r 中没有更多数据
+// 分块读满时预读一个字节判断是否结束，数据长度正好是分块长度的整数倍时不会多发一个空分块
+func readPart(br *bufio.Reader, buf []byte) (n int, last bool, err error) {
+	n, err = io.ReadFull(br, buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	default:
+		return n, false, err
+	}
+	if _, err := br.Peek(1); err != nil {
+		if err == io.EOF {
+			return n, true, nil
+		}
+		return n, false, err
+	}
+	return n, false, nil
+}
@@ -0,0 +1,375 @@
+package dstp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// handshakePair 在 net.Pipe 上建立两个完成握手的连接
+// net.Pipe 的写入要等对方读取，分块之间的写锁竞争可以被确定地观察到
+func handshakePair(t *testing.T, opts ConnOptions) (client, server *Conn) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client, server = NewConnWithOptions(&c1, opts), NewConnWithOptions(&c2, opts)
+	// 服务端在读到 HELLO 的 Receive 中回复 HELLO-ACK
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var f Frame
+		for {
+			if err := server.receiveContext(context.Background(), &f); err != nil || f.Type == frameExt {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if _, ok := server.Features(); !ok {
+		t.Fatal("server did not complete handshake")
+	}
+	return client, server
+}
+
+func TestStreamParts(t *testing.T) {
+	sender, receiver := handshakePair(t, DefaultConnOptions())
+	defer sender.Close()
+	defer receiver.Close()
+
+	big := make([]byte, 5*streamPartSize+100)
+	rand.New(rand.NewSource(1)).Read(big)
+	go func() {
+		sender.SendWithOptions(big, SendOptions{Stream: 2})
+		sender.SendWithOptions([]byte("tick"), SendOptions{Stream: 3, Priority: PriorityControl})
+		sender.Send([]byte("plain"), false)
+	}()
+
+	want := []struct {
+		data     []byte
+		stream   uint16
+		priority Priority
+	}{
+		{big, 2, PriorityNormal},
+		{[]byte("tick"), 3, PriorityControl},
+		{[]byte("plain"), 0, PriorityNormal},
+	}
+	var f Frame
+	for _, w := range want {
+		if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f.Payload, w.data) || f.Stream != w.stream || f.Priority != w.priority {
+			t.Fatalf("got %d bytes on stream %d priority %d, want %d bytes on stream %d priority %d",
+				len(f.Payload), f.Stream, f.Priority, len(w.data), w.stream, w.priority)
+		}
+	}
+}
+
+func TestStreamPreempt(t *testing.T) {
+	sender, receiver := handshakePair(t, DefaultConnOptions())
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 大块数据的第一个分块写出时对方还没有读取，写锁被一直占用
+	bulk := bytes.Repeat([]byte{'b'}, 8*streamPartSize)
+	go sender.SendWithOptions(bulk, SendOptions{Priority: PriorityBulk})
+	waitLocked := func(waiters int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			l := &sender.writeMtx
+			l.mtx.Lock()
+			ok := l.locked && len(l.waiters) == waiters
+			l.mtx.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("write lock never had %d waiters", waiters)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitLocked(0)
+	go sender.SendWithOptions([]byte("remove_point"), SendOptions{Stream: 1, Priority: PriorityControl})
+	waitLocked(1)
+
+	// 控制消息在第一个分块之后插队，先于大块数据完整到达
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "remove_point" {
+		t.Fatalf("got %d bytes on stream %d first", len(f.Payload), f.Stream)
+	}
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Payload, bulk) || f.Priority != PriorityBulk {
+		t.Fatalf("got %d bytes priority %d", len(f.Payload), f.Priority)
+	}
+}
+
+func TestStreamRetransmit(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 50, Backoff: 20 * time.Millisecond}
+	sender, receiver := PipeWithOptions(PipeOptions{Loss: 0.1, Seed: 3}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	got := make(chan []byte, 8)
+	go func() {
+		for {
+			data, type_, err := receiver.Receive()
+			if err != nil {
+				return
+			}
+			if type_ == FrameMessage {
+				got <- data
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 丢失分块的消息整条重传，接收方只交付完整的消息
+	messages := make([][]byte, 3)
+	for i := range messages {
+		messages[i] = bytes.Repeat([]byte{byte('a' + i)}, 3*streamPartSize)
+		if err := sender.SendAndWaitWithOptions(ctx, messages[i], SendOptions{Stream: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range messages {
+		select {
+		case data := <-got:
+			if !bytes.Equal(data, messages[i]) {
+				t.Fatalf("message %d: got %d bytes", i, len(data))
+			}
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+}
+
+func TestStreamOutlivesDedupWindow(t *testing.T) {
+	// 分块消息拼接期间有超过去重窗口的新消息先完成，完成时仍然交付
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	receiver := NewConn(&c2)
+	defer receiver.Close()
+
+	const newer = seqWindowSize + 10
+	go func() {
+		e := getEncoder()
+		defer putEncoder(e)
+		s := streamInfo{stream: 2}
+		write := func() bool {
+			err := e.writeTo(c1)
+			e.buf = e.buf[:0]
+			return err == nil
+		}
+		e.streamData(0, 1, s, 0, false, []byte("slow "))
+		if !write() {
+			return
+		}
+		for id := uint32(2); id < newer+2; id++ {
+			e.data(0, id, []byte("fast"))
+			if !write() {
+				return
+			}
+		}
+		e.streamData(0, 1, s, 1, true, []byte("part"))
+		write()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < newer; i++ {
+		data, _, err := receiver.ReceiveContext(ctx)
+		if err != nil || string(data) != "fast" {
+			t.Fatalf("message %d: got %q, %v", i, data, err)
+		}
+	}
+	data, _, err := receiver.ReceiveContext(ctx)
+	if err != nil || string(data) != "slow part" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if _, _, dups := receiver.recvSeq.snapshot(); dups != 0 {
+		t.Fatalf("%d duplicates", dups)
+	}
+}
+
+// partBoundarySizes 分块和分段边界附近的消息长度
+var partBoundarySizes = []int{
+	0, 1, streamPartSize - 1, streamPartSize, streamPartSize + 1,
+	2 * streamPartSize, maxSegmentLen, maxSegmentLen + 1, 4 * streamPartSize,
+}
+
+func TestReadPart(t *testing.T) {
+	// 长度正好是分块长度的整数倍时不多读出一个空分块
+	s := &streamInfo{}
+	buf := make([]byte, streamPartSize)
+	for _, size := range partBoundarySizes {
+		br := bufio.NewReaderSize(iotest.HalfReader(bytes.NewReader(make([]byte, size))), streamPartSize)
+		parts, total := 0, 0
+		for {
+			n, last, err := readPart(br, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts++
+			total += n
+			if last {
+				break
+			}
+		}
+		if parts != partCount(size, s) || total != size {
+			t.Errorf("size %d: %d bytes in %d parts, want %d parts", size, total, parts, partCount(size, s))
+		}
+	}
+}
+
+func TestSendBoundaries(t *testing.T) {
+	streamed, streamedPeer := handshakePair(t, DefaultConnOptions())
+	defer streamed.Close()
+	defer streamedPeer.Close()
+	// 没有握手的连接不使用流头
+	c1, c2 := net.Pipe()
+	plain, plainPeer := NewConn(&c1), NewConn(&c2)
+	defer plain.Close()
+	defer plainPeer.Close()
+
+	rnd := rand.New(rand.NewSource(2))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, pair := range []struct {
+		name             string
+		sender, receiver *Conn
+		stream           uint16
+	}{
+		{"streamed", streamed, streamedPeer, 2},
+		{"plain", plain, plainPeer, 0},
+	} {
+		for _, size := range partBoundarySizes {
+			data := make([]byte, size)
+			rnd.Read(data)
+			sent := make(chan error, 2)
+			go func() {
+				_, err := pair.sender.SendWithOptions(data, SendOptions{Stream: pair.stream})
+				sent <- err
+				_, err = pair.sender.SendReader(ctx, iotest.HalfReader(bytes.NewReader(data)), SendOptions{Stream: pair.stream})
+				sent <- err
+			}()
+			for _, how := range []string{"bytes", "reader"} {
+				var f Frame
+				if err := pair.receiver.ReceiveFrame(ctx, &f); err != nil {
+					t.Fatalf("%s %s size %d: %v", pair.name, how, size, err)
+				}
+				if !bytes.Equal(f.Payload, data) || f.Stream != pair.stream {
+					t.Fatalf("%s %s size %d: got %d bytes on stream %d", pair.name, how, size, len(f.Payload), f.Stream)
+				}
+				if err := <-sent; err != nil {
+					t.Fatalf("%s %s size %d: %v", pair.name, how, size, err)
+				}
+			}
+		}
+	}
+}
+
+func TestSendReaderError(t *testing.T) {
+	sender, receiver := handshakePair(t, DefaultConnOptions())
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 读取出错时已写出的分块被对方丢弃，同一个流上的下一条消息完整到达
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(make([]byte, 2*streamPartSize)), iotest.ErrReader(errRead))
+	sent := make(chan error, 1)
+	go func() {
+		_, err := sender.SendReader(context.Background(), r, SendOptions{Stream: 2})
+		sent <- err
+		sender.SendReader(context.Background(), bytes.NewReader([]byte("next")), SendOptions{Stream: 2})
+	}()
+	var f Frame
+	if err := receiver.ReceiveFrame(context.Background(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "next" {
+		t.Fatalf("got %d bytes", len(f.Payload))
+	}
+	if err := <-sent; !errors.Is(err, errRead) {
+		t.Fatalf("got %v, want %v", err, errRead)
+	}
+}
+
+func TestSendReaderRetransmit(t *testing.T) {
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 50, Backoff: 20 * time.Millisecond}
+	sender, receiver := PipeWithOptions(PipeOptions{Loss: 0.1, Seed: 4}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			data, type_, err := receiver.Receive()
+			if err != nil {
+				return
+			}
+			if type_ == FrameMessage {
+				got <- data
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sender.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 需要应答的消息保留已发送的数据，丢失分块时整条重传
+	data := bytes.Repeat([]byte("reader"), streamPartSize)
+	done := make(chan error, 1)
+	_, err := sender.SendReader(ctx, bytes.NewReader(data), SendOptions{
+		NeedAck:  true,
+		OnResult: func(_ uint32, err error) { done <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(<-got, data) {
+		t.Fatal("payload mismatch")
+	}
+}
@@ -0,0 +1,124 @@
+package dstp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions TLS 证书配置，文件均为 PEM 格式
+type TLSOptions struct {
+	CertFile string // 本端证书，服务端必须提供，客户端在双向认证时提供
+	KeyFile  string
+	// CAFile 固定的 CA 证书，客户端只信任它签发的服务端证书，为空时使用系统根证书
+	// 服务端要求客户端证书时用它验证客户端
+	CAFile            string
+	RequireClientCert bool   // 服务端要求客户端提供证书(双向认证)
+	ServerName        string // 客户端校验的服务端名称，为空时使用拨号地址中的主机名
+}
+
+// TLSOptionsFromEnv 从环境变量读取 TLS 配置，DSTP_TLS 不为空时 ok 为 true
+// DSTP_TLS_CERT DSTP_TLS_KEY DSTP_TLS_CA DSTP_TLS_SERVER_NAME 对应 TLSOptions 的字段
+// DSTP_TLS_CLIENT_AUTH 不为空时服务端要求客户端证书
+func TLSOptionsFromEnv() (opts TLSOptions, ok bool) {
+	if os.Getenv("DSTP_TLS") == "" {
+		return TLSOptions{}, false
+	}
+	return TLSOptions{
+		CertFile:          os.Getenv("DSTP_TLS_CERT"),
+		KeyFile:           os.Getenv("DSTP_TLS_KEY"),
+		CAFile:            os.Getenv("DSTP_TLS_CA"),
+		RequireClientCert: os.Getenv("DSTP_TLS_CLIENT_AUTH") != "",
+		ServerName:        os.Getenv("DSTP_TLS_SERVER_NAME"),
+	}, true
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("dstp: read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("dstp: no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig 生成服务端的 TLS 配置
+func ServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dstp: load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.RequireClientCert {
+		if opts.CAFile == "" {
+			return nil, errors.New("dstp: client certificate verification needs a ca file")
+		}
+		config.ClientCAs, err = loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig 生成客户端的 TLS 配置
+func ClientTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("dstp: load certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Listen 监听 address，config 不为 nil 时只接受 TLS 连接
+func Listen(network, address string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen(network, address)
+	}
+	return tls.Listen(network, address, config)
+}
+
+// Dial 使用默认选项连接 address，config 不为 nil 时使用 TLS
+func Dial(network, address string, config *tls.Config) (*Conn, error) {
+	return DialContext(context.Background(), network, address, config, DefaultConnOptions())
+}
+
+// DialContext 连接 address，使用 TLS 时在返回前完成 TLS 握手，ctx 控制连接和握手的时间
+func DialContext(ctx context.Context, network, address string, config *tls.Config, opts ConnOptions) (*Conn, error) {
+	var conn net.Conn
+	var err error
+	if config == nil {
+		conn, err = (&net.Dialer{}).DialContext(ctx, network, address)
+	} else {
+		conn, err = (&tls.Dialer{Config: config}).DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConnWithOptions(&conn, opts), nil
+}
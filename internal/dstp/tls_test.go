@@ -0,0 +1,189 @@
+package dstp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert 测试用证书，key 和 cert 已写入临时目录
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert 生成证书，parent 为 nil 时生成自签名的 CA
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+// serveOnce 接受一个连接并回显收到的第一条消息
+func serveOnce(t *testing.T, config *tls.Config) (string, <-chan error) {
+	t.Helper()
+	l, err := Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		c := NewConn(&conn)
+		defer c.Close()
+		data, _, err := c.Receive()
+		if err == nil {
+			err = c.Send(data, false)
+		}
+		errs <- err
+	}()
+	return l.Addr().String(), errs
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "localhost", ca)
+	client := newTestCert(t, "client", ca)
+
+	serverConfig, err := ServerTLSConfig(TLSOptions{
+		CertFile:          server.certFile,
+		KeyFile:           server.keyFile,
+		CAFile:            ca.certFile,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, errs := serveOnce(t, serverConfig)
+
+	clientConfig, err := ClientTLSConfig(TLSOptions{
+		CertFile:   client.certFile,
+		KeyFile:    client.keyFile,
+		CAFile:     ca.certFile,
+		ServerName: "localhost",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, "tcp", addr, clientConfig, DefaultConnOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Send([]byte("token"), false); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := conn.Receive()
+	if err != nil || string(data) != "token" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSRejected(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	otherCA := newTestCert(t, "other-ca", nil)
+	server := newTestCert(t, "localhost", ca)
+	stranger := newTestCert(t, "stranger", otherCA)
+
+	serverConfig, err := ServerTLSConfig(TLSOptions{
+		CertFile:          server.certFile,
+		KeyFile:           server.keyFile,
+		CAFile:            ca.certFile,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		opts TLSOptions
+	}{
+		// 服务端证书不是固定的 CA 签发的
+		{"pinned ca", TLSOptions{CAFile: otherCA.certFile, ServerName: "localhost"}},
+		// 客户端证书不是服务端信任的 CA 签发的
+		{"client cert", TLSOptions{CertFile: stranger.certFile, KeyFile: stranger.keyFile, CAFile: ca.certFile, ServerName: "localhost"}},
+	}
+	for _, tc := range cases {
+		addr, errs := serveOnce(t, serverConfig)
+		clientConfig, err := ClientTLSConfig(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := DialContext(ctx, "tcp", addr, clientConfig, DefaultConnOptions())
+		if err == nil {
+			// TLS 1.3 下客户端证书在握手完成后才被服务端拒绝
+			conn.Send([]byte("token"), false)
+			_, _, err = conn.Receive()
+			conn.Close()
+		}
+		cancel()
+		if err == nil {
+			t.Errorf("%s: connection accepted", tc.name)
+		}
+		if err := <-errs; err == nil {
+			t.Errorf("%s: server accepted connection", tc.name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dstp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// FrameInfo 追踪时报告的一个数据包的头部信息
+type FrameInfo struct {
+	Type     FrameType
+	Id       uint32 // 消息id，ack 包为被应答的消息id，ping/pong 包为 0
+	Flags    byte   // 控制标记
+	Stream   uint16 // 带流头时为所在的流
+	Segments int    // 分段数，ping/pong/ack 包为 0
+	Size     int    // 数据包在线路上的字节数
+}
+
+// Tracer 接收连接上逐个数据包的事件，用于调试和导出指标
+// 方法在发送方和接收协程中并发调用，OnFrameSent 调用时持有写锁，实现不能阻塞，也不能调用连接的方法
+type Tracer interface {
+	// OnFrameSent 数据包完整写出后调用，包括 ack、ping/pong 和握手等扩展包
+	OnFrameSent(f FrameInfo)
+	// OnFrameReceived 读到校验通过的完整数据包后调用，在解压和拼接分块之前
+	OnFrameReceived(f FrameInfo)
+	// OnRetransmit 重传需要应答的消息前调用，attempt 从 1 开始
+	OnRetransmit(messageId uint32, attempt int)
+	// OnAck 收到应答时调用，latency 为从首次发送到收到应答的时间
+	OnAck(messageId uint32, latency time.Duration)
+}
+
+// frameCounters 按数据包类型统计的数量，下标见 frameSlot
+type frameCounters [FrameStream + 1]atomic.Uint64
+
+// frameSlot 返回类型的计数下标，扩展包使用 0
+func frameSlot(t FrameType) int {
+	if t >= FrameMessage && t <= FrameStream {
+		return int(t)
+	}
+	return 0
+}
+
+// snapshot 返回非零计数的副本
+func (fc *frameCounters) snapshot() map[FrameType]uint64 {
+	m := make(map[FrameType]uint64)
+	for i := range fc {
+		if n := fc[i].Load(); n > 0 {
+			t := FrameType(i)
+			if i == 0 {
+				t = frameExt
+			}
+			m[t] = n
+		}
+	}
+	return m
+}
+
+// traffic 连接收发的数据包、字节和分段数
+type traffic struct {
+	bytesSent      atomic.Uint64
+	bytesRecved    atomic.Uint64
+	framesSent     frameCounters
+	framesRecved   frameCounters
+	segmentsSent   atomic.Uint64
+	segmentsRecved atomic.Uint64
+	retransmits    atomic.Uint64
+}
+
+// info 返回已编码数据包的头部信息，必须在 seal 之后调用
+func (e *frameEncoder) info() FrameInfo {
+	f := FrameInfo{Type: e.typ, Flags: e.buf[1], Stream: e.stream, Segments: e.segs, Size: len(e.buf)}
+	if e.typ != FramePing && e.typ != FramePong {
+		f.Id = binary.BigEndian.Uint32(e.buf[2:6])
+	}
+	return f
+}
+
+// frameInfo 返回接收到的数据包的头部信息
+func frameInfo(f *Frame, size int) FrameInfo {
+	return FrameInfo{Type: f.Type, Id: f.Id, Flags: f.Flags, Stream: f.Stream, Segments: f.Segments, Size: size}
+}
+
+// onFrameSent 统计并追踪完整写出的数据包
+func (c *Conn) onFrameSent(e *frameEncoder) {
+	info := e.info()
+	c.traffic.bytesSent.Add(uint64(info.Size))
+	c.traffic.framesSent[frameSlot(info.Type)].Add(1)
+	c.traffic.segmentsSent.Add(uint64(info.Segments))
+	if c.opts.Tracer != nil {
+		c.opts.Tracer.OnFrameSent(info)
+	}
+}
+
+// onFrameReceived 统计并追踪读到的完整数据包
+func (c *Conn) onFrameReceived(f *Frame) {
+	size := c.dec.consumed
+	c.traffic.bytesRecved.Add(uint64(size))
+	c.traffic.framesRecved[frameSlot(f.Type)].Add(1)
+	c.traffic.segmentsRecved.Add(uint64(f.Segments))
+	if c.opts.Tracer != nil {
+		c.opts.Tracer.OnFrameReceived(frameInfo(f, size))
+	}
+}
+
+// onRetransmit 统计并追踪一次重传
+func (c *Conn) onRetransmit(messageId uint32, attempt int) {
+	c.traffic.retransmits.Add(1)
+	if c.opts.Tracer != nil {
+		c.opts.Tracer.OnRetransmit(messageId, attempt)
+	}
+}
+
+// onAck 统计并追踪收到应答的消息
+func (c *Conn) onAck(messageId uint32, p *pendingAck) {
+	latency := time.Since(p.sentAt)
+	c.ackLatency.observe(latency)
+	if c.opts.Tracer != nil {
+		c.opts.Tracer.OnAck(messageId, latency)
+	}
+}
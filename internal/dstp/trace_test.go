@@ -0,0 +1,164 @@
+package dstp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordTracer 记录收到的所有追踪事件
+type recordTracer struct {
+	mtx         sync.Mutex
+	sent        []FrameInfo
+	received    []FrameInfo
+	retransmits []uint32
+	acks        []time.Duration
+}
+
+func (r *recordTracer) OnFrameSent(f FrameInfo) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.sent = append(r.sent, f)
+}
+
+func (r *recordTracer) OnFrameReceived(f FrameInfo) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.received = append(r.received, f)
+}
+
+func (r *recordTracer) OnRetransmit(messageId uint32, attempt int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.retransmits = append(r.retransmits, messageId)
+}
+
+func (r *recordTracer) OnAck(messageId uint32, latency time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.acks = append(r.acks, latency)
+}
+
+func TestStatsTraffic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	var st, rt recordTracer
+	opts := DefaultConnOptions()
+	opts.Tracer = &st
+	sender := NewConnWithOptions(&c1, opts)
+	opts.Tracer = &rt
+	receiver := NewConnWithOptions(&c2, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go func() {
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := make([]byte, maxSegmentLen+10)
+	if err := sender.SendAndWait(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// 接收方的 Write 在发送方读到 ack 之后才返回，等待接收方计入 ack
+	deadline := time.Now().Add(5 * time.Second)
+	for receiver.Stats().FramesSent[FrameAck] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ack not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s, r := sender.Stats(), receiver.Stats()
+	size := uint64(frameSize(len(data)))
+	if s.BytesSent != size || r.BytesReceived != size {
+		t.Fatalf("sent %d, received %d bytes, want %d", s.BytesSent, r.BytesReceived, size)
+	}
+	if s.SegmentsSent != 2 || r.SegmentsReceived != 2 {
+		t.Fatalf("sent %d, received %d segments, want 2", s.SegmentsSent, r.SegmentsReceived)
+	}
+	if s.FramesSent[FrameMessage] != 1 || r.FramesReceived[FrameMessage] != 1 {
+		t.Fatalf("sent %v, received %v", s.FramesSent, r.FramesReceived)
+	}
+	if r.FramesSent[FrameAck] != 1 || s.FramesReceived[FrameAck] != 1 || s.BytesReceived != r.BytesSent {
+		t.Fatalf("ack: sent %v, received %v", r.FramesSent, s.FramesReceived)
+	}
+	if s.AcksReceived != 1 || s.AckLatency <= 0 || s.SmoothedAckLatency != s.AckLatency || s.Retransmits != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	want := FrameInfo{Type: FrameMessage, Id: 1, Flags: ctrlNeedAck | ctrlSeg, Segments: 2, Size: int(size)}
+	if len(st.sent) != 1 || st.sent[0] != want {
+		t.Fatalf("sent %+v, want %+v", st.sent, want)
+	}
+	if len(st.received) != 1 || st.received[0].Type != FrameAck || st.received[0].Id != 1 {
+		t.Fatalf("received %+v", st.received)
+	}
+	if len(st.acks) != 1 || st.acks[0] != s.AckLatency {
+		t.Fatalf("acks %v", st.acks)
+	}
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	if len(rt.received) != 1 || rt.received[0] != want {
+		t.Fatalf("received %+v, want %+v", rt.received, want)
+	}
+}
+
+func TestTracerRetransmit(t *testing.T) {
+	var tracer recordTracer
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 10, Backoff: 10 * time.Millisecond}
+	opts.Tracer = &tracer
+	sender, receiver := PipeWithOptions(PipeOptions{}, opts)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go func() {
+		for {
+			if _, _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	// 接收方晚于第一次重传才开始读取
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for {
+			if _, _, err := receiver.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sender.SendAndWait(ctx, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := sender.Stats()
+	if s.Retransmits == 0 || s.AcksReceived != 1 || s.AckLatency < 50*time.Millisecond {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	if uint64(len(tracer.retransmits)) < s.Retransmits || tracer.retransmits[0] != 1 {
+		t.Fatalf("retransmits %v, stats %d", tracer.retransmits, s.Retransmits)
+	}
+	if len(tracer.acks) != 1 {
+		t.Fatalf("acks %v", tracer.acks)
+	}
+}
@@ -0,0 +1,500 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+UDP 传输
+每个数据包单独放在一个数据报中，超过 MaxDatagramSize 的数据包拆成多个分片:
+|0x04|分片序号(4)|分片下标(2)|分片总数(2)|数据|
+接收方在 ReassemblyTimeout 内收齐所有分片后交给 Conn 解析，超时则整个数据包丢弃
+不需要应答的消息丢失后不重发，需要应答的消息由 Conn 按重传策略重发
+*/
+
+// 分片数据报的开始标记，与数据包的开始标记区分
+const dataFragment byte = 0x04
+
+const fragHeaderLen = 1 + 4 + 2 + 2
+
+// 单个数据报的最大长度，UDP 载荷不能超过 65507 字节
+const maxUDPPayload = 65507
+
+// 套接字接收缓冲区大小，分片较多的数据包一次到达时避免被内核丢弃
+const udpReadBuffer = 4 << 20
+
+// UDPOptions UDP 传输选项
+type UDPOptions struct {
+	MaxDatagramSize    int           // 单个数据报的最大长度，超过时分片，0 按 1200 处理
+	ReassemblyTimeout  time.Duration // 分片重组的最长等待时间，0 按 2 秒处理
+	MaxReassemblyBytes int           // 每个连接正在重组的分片总长度上限，0 按 16MiB 处理
+}
+
+func (o UDPOptions) withDefaults() UDPOptions {
+	if o.MaxDatagramSize <= fragHeaderLen {
+		o.MaxDatagramSize = 1200
+	}
+	o.MaxDatagramSize = min(o.MaxDatagramSize, maxUDPPayload)
+	if o.ReassemblyTimeout <= 0 {
+		o.ReassemblyTimeout = 2 * time.Second
+	}
+	if o.MaxReassemblyBytes <= 0 {
+		o.MaxReassemblyBytes = 16 << 20
+	}
+	return o
+}
+
+// reassembly 一个正在重组的数据包
+type reassembly struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// udpConn 将 UDP 上与一个对端之间的数据报包装成 net.Conn
+// 每次 Write 发送一个数据包，Read 每次返回完整数据包中的数据
+type udpConn struct {
+	pc      net.PacketConn
+	raddr   net.Addr
+	opts    UDPOptions
+	in      chan []byte // 收到的数据报，由读取协程或监听器写入
+	fragSeq atomic.Uint32
+	onClose func()
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       atomic.Pointer[error]
+
+	rdMtx     sync.Mutex
+	rd        time.Time
+	rdChanged chan struct{} // 修改读取截止时间时关闭，唤醒阻塞的 Read
+
+	// 以下只在 Read 中使用
+	frame      []byte // 已重组还没有读完的数据包
+	reasm      map[uint32]*reassembly
+	reasmBytes int
+}
+
+func newUDPConn(pc net.PacketConn, raddr net.Addr, opts UDPOptions, onClose func()) *udpConn {
+	return &udpConn{
+		pc:        pc,
+		raddr:     raddr,
+		opts:      opts.withDefaults(),
+		in:        make(chan []byte, 256),
+		onClose:   onClose,
+		closed:    make(chan struct{}),
+		rdChanged: make(chan struct{}),
+		reasm:     make(map[uint32]*reassembly),
+	}
+}
+
+// deliver 交给连接一个数据报，队列满时丢弃
+func (c *udpConn) deliver(datagram []byte) {
+	select {
+	case c.in <- datagram:
+	default:
+	}
+}
+
+// fail 连接出错或关闭，之后的 Read 和 Write 返回 err
+func (c *udpConn) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err.Store(&err)
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *udpConn) closeErr() error {
+	if err := c.err.Load(); err != nil {
+		return *err
+	}
+	return net.ErrClosed
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.frame) > 0 {
+			n := copy(p, c.frame)
+			c.frame = c.frame[n:]
+			return n, nil
+		}
+
+		c.rdMtx.Lock()
+		deadline, changed := c.rd, c.rdChanged
+		c.rdMtx.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case datagram := <-c.in:
+			c.frame = c.reassemble(datagram, time.Now())
+		case <-changed:
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.closed:
+			err = c.closeErr()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reassemble 处理一个数据报，收齐一个完整的数据包时返回它
+func (c *udpConn) reassemble(datagram []byte, now time.Time) []byte {
+	if len(datagram) == 0 || datagram[0] != dataFragment {
+		return datagram
+	}
+	c.expire(now)
+	if len(datagram) < fragHeaderLen {
+		return nil
+	}
+	seq := binary.BigEndian.Uint32(datagram[1:])
+	index := int(binary.BigEndian.Uint16(datagram[5:]))
+	count := int(binary.BigEndian.Uint16(datagram[7:]))
+	part := datagram[fragHeaderLen:]
+	if index >= count || c.reasmBytes+len(part) > c.opts.MaxReassemblyBytes {
+		return nil
+	}
+
+	r := c.reasm[seq]
+	if r == nil {
+		r = &reassembly{parts: make([][]byte, count), started: now}
+		c.reasm[seq] = r
+	}
+	if len(r.parts) != count || r.parts[index] != nil {
+		return nil
+	}
+	r.parts[index] = part
+	r.received++
+	r.size += len(part)
+	c.reasmBytes += len(part)
+	if r.received < count {
+		return nil
+	}
+
+	delete(c.reasm, seq)
+	c.reasmBytes -= r.size
+	frame := make([]byte, 0, r.size)
+	for _, part := range r.parts {
+		frame = append(frame, part...)
+	}
+	return frame
+}
+
+// expire 丢弃超时没有收齐的数据包
+func (c *udpConn) expire(now time.Time) {
+	for seq, r := range c.reasm {
+		if now.Sub(r.started) > c.opts.ReassemblyTimeout {
+			delete(c.reasm, seq)
+			c.reasmBytes -= r.size
+		}
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.closeErr()
+	default:
+	}
+	size := c.opts.MaxDatagramSize
+	if len(p) <= size {
+		if _, err := c.pc.WriteTo(p, c.raddr); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	partLen := size - fragHeaderLen
+	count := (len(p) + partLen - 1) / partLen
+	if count > 0xFFFF {
+		return 0, fmt.Errorf("%w: %d bytes need %d fragments", ErrFrameTooLarge, len(p), count)
+	}
+	seq := c.fragSeq.Add(1)
+	buf := make([]byte, 0, size)
+	for i := 0; i < count; i++ {
+		part := p[i*partLen : min((i+1)*partLen, len(p))]
+		buf = append(buf[:0], dataFragment)
+		buf = binary.BigEndian.AppendUint32(buf, seq)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(i))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(count))
+		buf = append(buf, part...)
+		if _, err := c.pc.WriteTo(buf, c.raddr); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *udpConn) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr  { return c.pc.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr { return c.raddr }
+
+// lossy 数据报可能丢失
+func (c *udpConn) lossy() bool { return true }
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.rdMtx.Lock()
+	defer c.rdMtx.Unlock()
+	c.rd = t
+	close(c.rdChanged)
+	c.rdChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline UDP 写入不会阻塞，忽略写入截止时间
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// readDatagrams 从 pc 读取数据报，filter 返回接收该数据报的连接，返回 nil 时丢弃
+func readDatagrams(pc net.PacketConn, filter func(addr net.Addr, datagram []byte) *udpConn) error {
+	if uc, ok := pc.(*net.UDPConn); ok {
+		uc.SetReadBuffer(udpReadBuffer)
+	}
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if c := filter(addr, buf[:n]); c != nil {
+			c.deliver(append([]byte(nil), buf[:n]...))
+		}
+	}
+}
+
+// DialUDP 通过 UDP 连接 address
+// 数据报可能丢失或损坏，opts.Resync 总是被设置为 true
+func DialUDP(ctx context.Context, address string, udpOpts UDPOptions, opts ConnOptions) (*Conn, error) {
+	raddr, err := resolveUDPAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return newUDPClient(pc, raddr, udpOpts, opts), nil
+}
+
+// newUDPClient 在 pc 上创建只与 raddr 通信的连接
+func newUDPClient(pc net.PacketConn, raddr *net.UDPAddr, udpOpts UDPOptions, opts ConnOptions) *Conn {
+	uc := newUDPConn(pc, raddr, udpOpts, func() { pc.Close() })
+	go func() {
+		err := readDatagrams(pc, func(addr net.Addr, _ []byte) *udpConn {
+			if a, ok := addr.(*net.UDPAddr); !ok || !a.IP.Equal(raddr.IP) || a.Port != raddr.Port {
+				return nil
+			}
+			return uc
+		})
+		uc.fail(err)
+	}()
+
+	conn := net.Conn(uc)
+	opts.Resync = true
+	return NewConnWithOptions(&conn, opts)
+}
+
+func resolveUDPAddr(ctx context.Context, address string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: net.IP(ips[0].Unmap().AsSlice()), Port: portNum}, nil
+}
+
+// 同时重组 HELLO 分片的新对端数量和每个对端缓存的分片长度上限
+const (
+	maxPendingPeers = 64
+	maxHelloSize    = 64 << 10
+)
+
+// UDPListener 在一个 UDP 端口上按对端地址区分连接，实现 net.Listener
+// 对端需要先调用 Handshake，收到 HELLO 后才创建连接
+// 用 Accept 得到的连接创建 Conn 时应设置 ConnOptions.Resync
+type UDPListener struct {
+	pc        net.PacketConn
+	opts      UDPOptions
+	mtx       sync.Mutex
+	conns     map[string]*udpConn
+	pending   map[string]*udpConn // 正在重组 HELLO 分片的新对端，只用于重组
+	accept    chan *udpConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenUDP 监听 UDP 地址 address
+func ListenUDP(address string, opts UDPOptions) (*UDPListener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &UDPListener{
+		pc:      pc,
+		opts:    opts,
+		conns:   make(map[string]*udpConn),
+		pending: make(map[string]*udpConn),
+		accept:  make(chan *udpConn, 16),
+		closed:  make(chan struct{}),
+	}
+	go func() {
+		readDatagrams(pc, l.route)
+		l.Close()
+	}()
+	return l, nil
+}
+
+// route 找到对端地址对应的连接，新的对端创建连接等待 Accept
+// 新的对端必须以 HELLO 开始，已关闭的连接迟到的数据报和其他数据报直接丢弃
+// 超过 MaxDatagramSize 的 HELLO 收齐分片后再检查，重组好的 HELLO 直接交给新连接
+func (l *UDPListener) route(addr net.Addr, datagram []byte) *udpConn {
+	key := addr.String()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if c, ok := l.conns[key]; ok {
+		return c
+	}
+	hello, reassembled := datagram, false
+	if len(datagram) > 0 && datagram[0] == dataFragment {
+		if hello = l.reassembleHello(key, datagram); hello == nil {
+			return nil
+		}
+		reassembled = true
+	}
+	if !isHello(hello) {
+		return nil
+	}
+	c := newUDPConn(l.pc, addr, l.opts, func() {
+		l.mtx.Lock()
+		delete(l.conns, key)
+		l.mtx.Unlock()
+	})
+	select {
+	case l.accept <- c:
+		l.conns[key] = c
+	default:
+		// 来不及 Accept，丢弃这个对端的数据报
+		return nil
+	}
+	if reassembled {
+		c.deliver(hello)
+		return nil
+	}
+	return c
+}
+
+// reassembleHello 重组新对端的分片，收齐一个数据包时返回它
+// 同时重组的对端数量和每个对端缓存的长度有上限，超时没有收齐的分片被丢弃
+func (l *UDPListener) reassembleHello(key string, datagram []byte) []byte {
+	now := time.Now()
+	p := l.pending[key]
+	if p == nil {
+		if len(l.pending) >= maxPendingPeers {
+			l.expirePending(now)
+			if len(l.pending) >= maxPendingPeers {
+				return nil
+			}
+		}
+		opts := l.opts
+		opts.MaxReassemblyBytes = maxHelloSize
+		p = newUDPConn(nil, nil, opts, nil)
+		l.pending[key] = p
+	}
+	// datagram 是读取缓冲区，下一次读取前复制
+	frame := p.reassemble(append([]byte(nil), datagram...), now)
+	if frame != nil || len(p.reasm) == 0 {
+		delete(l.pending, key)
+	}
+	return frame
+}
+
+// expirePending 移除分片已经超时的新对端
+func (l *UDPListener) expirePending(now time.Time) {
+	for key, p := range l.pending {
+		p.expire(now)
+		if len(p.reasm) == 0 {
+			delete(l.pending, key)
+		}
+	}
+}
+
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭监听，已经建立的连接同时失效
+func (l *UDPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.pc.Close()
+		l.mtx.Lock()
+		conns := l.conns
+		l.conns = make(map[string]*udpConn)
+		l.mtx.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return nil
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// isHello 判断数据报是否为一个完整、校验通过的 HELLO 数据包
+func isHello(datagram []byte) bool {
+	if len(datagram) == 0 || datagram[0] != dataStart {
+		return false
+	}
+	c := &Conn{dec: newFrameDecoder(bytes.NewReader(datagram))}
+	var f Frame
+	return c.readFrame(&f) == nil && f.Type == frameExt && len(f.Payload) > 0 && f.Payload[0] == extHello
+}
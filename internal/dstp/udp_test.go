@@ -0,0 +1,266 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn 丢弃每隔一个写出的数据报
+type lossyPacketConn struct {
+	net.PacketConn
+	writes atomic.Int64
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.writes.Add(1)%2 == 0 {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// udpEcho 接受 UDP 连接并回显收到的消息
+func udpEcho(t *testing.T) *UDPListener {
+	t.Helper()
+	l, err := ListenUDP("127.0.0.1:0", UDPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			opts := DefaultConnOptions()
+			opts.Resync = true
+			c := NewConnWithOptions(&conn, opts)
+			go func() {
+				for {
+					data, type_, err := c.Receive()
+					if err != nil {
+						return
+					}
+					if type_ == FrameMessage {
+						c.Send(data, true)
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestUDP(t *testing.T) {
+	l := udpEcho(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialUDP(ctx, l.Addr().String(), UDPOptions{}, DefaultConnOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{40, 5000, maxSegmentLen + 5, 3*maxSegmentLen + 5} {
+		data := bytes.Repeat([]byte{'u'}, size)
+		if err := conn.Send(data, true); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			got, type_, err := conn.ReceiveContext(ctx)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if type_ != FrameMessage {
+				continue
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d: got %d bytes", size, len(got))
+			}
+			break
+		}
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	l, err := ListenUDP("127.0.0.1:0", UDPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultConnOptions()
+	opts.Retry = RetryPolicy{MaxRetries: 10, Backoff: 20 * time.Millisecond}
+	sender := newUDPClient(&lossyPacketConn{PacketConn: pc}, l.Addr().(*net.UDPAddr), UDPOptions{}, opts)
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 需要应答的消息经过重传全部送达且只交付一次，不需要应答的消息丢失后不重发
+	// 监听端收到 HELLO 后才接受连接，接收方在 Receive 中回复 HELLO-ACK
+	const n = 10
+	go func() {
+		if _, err := sender.Handshake(ctx); err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			for {
+				if _, _, err := sender.Receive(); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; i < n; i++ {
+			sender.Send([]byte{byte(i)}, true)
+			sender.Send([]byte("state"), false)
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewConnWithOptions(&conn, ConnOptions{Resync: true})
+	acked := make(map[byte]int)
+	for len(acked) < n {
+		data, type_, err := receiver.ReceiveContext(ctx)
+		if err != nil {
+			t.Fatalf("received %d of %d: %v", len(acked), n, err)
+		}
+		if type_ == FrameMessage && len(data) == 1 {
+			acked[data[0]]++
+		}
+	}
+	for id, count := range acked {
+		if count != 1 {
+			t.Fatalf("message %d delivered %d times", id, count)
+		}
+	}
+}
+
+func TestUDPListenerRequiresHello(t *testing.T) {
+	l, err := ListenUDP("127.0.0.1:0", UDPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// 没有握手的对端(例如已关闭的连接迟到的数据报)不会创建连接
+	stray, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+	e := getEncoder()
+	e.data(ctrlNeedAck, 7, []byte("late"))
+	stray.WriteTo(e.buf, l.Addr())
+	putEncoder(e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := DialUDP(ctx, l.Addr().String(), UDPOptions{}, DefaultConnOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Handshake(ctx)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() == stray.LocalAddr().String() {
+		t.Fatalf("accepted stray peer %v", conn.RemoteAddr())
+	}
+}
+
+func TestUDPFragmentedHello(t *testing.T) {
+	// HELLO 超过 MaxDatagramSize 时被拆成分片，监听端收齐后接受连接
+	udpOpts := UDPOptions{MaxDatagramSize: 64}
+	l, err := ListenUDP("127.0.0.1:0", udpOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	opts := DefaultConnOptions()
+	for i := range 40 {
+		opts.ReceiveStreams = append(opts.ReceiveStreams, uint16(i+1))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := DialUDP(ctx, l.Addr().String(), udpOpts, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	handshake := make(chan error, 1)
+	go func() {
+		_, err := client.Handshake(ctx)
+		handshake <- err
+	}()
+
+	// 没有收齐 HELLO 时 Accept 不会返回，超时后关闭监听
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewConnWithOptions(&conn, ConnOptions{Resync: true})
+	defer server.Close()
+	go func() {
+		for {
+			if _, _, err := server.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	if err := <-handshake; err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := server.Features(); !ok || len(f.ReceiveStreams) != 40 {
+		t.Fatalf("server features %+v, %v", f, ok)
+	}
+}
+
+func TestUDPReassemblyTimeout(t *testing.T) {
+	c := newUDPConn(nil, nil, UDPOptions{ReassemblyTimeout: time.Second}, nil)
+	frag := func(seq uint32, index, count uint16, data string) []byte {
+		buf := []byte{dataFragment}
+		buf = binary.BigEndian.AppendUint32(buf, seq)
+		buf = binary.BigEndian.AppendUint16(buf, index)
+		buf = binary.BigEndian.AppendUint16(buf, count)
+		return append(buf, data...)
+	}
+
+	now := time.Now()
+	if c.reassemble(frag(1, 1, 2, "world"), now) != nil {
+		t.Fatal("incomplete frame returned")
+	}
+	if got := c.reassemble(frag(1, 0, 2, "hello "), now); string(got) != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+
+	c.reassemble(frag(2, 0, 2, "lost"), now)
+	if got := c.reassemble(frag(2, 1, 2, "late"), now.Add(2*time.Second)); got != nil {
+		t.Fatalf("expired frame completed: %q", got)
+	}
+	if c.reasmBytes != 4 || len(c.reasm) != 1 {
+		t.Fatalf("reassembly state %d bytes %d frames, want only the late fragment", c.reasmBytes, len(c.reasm))
+	}
+}
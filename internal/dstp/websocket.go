@@ -0,0 +1,120 @@
+package dstp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn 将 WebSocket 连接包装成 net.Conn
+// 每次 Write 发送一条二进制消息，Conn 每个数据包只调用一次 Write，因此一条消息就是一个完整的数据包
+// Read 把收到的二进制消息当作连续的字节流，不依赖消息边界
+// WebSocket 连接读写出错(包括截止时间到达)后不能继续使用，ReceiveContext 被中断时连接随之失效
+type wsConn struct {
+	ws       *websocket.Conn
+	reader   io.Reader // 当前正在读取的消息
+	writeMtx sync.Mutex
+}
+
+// NewWebSocketConn 将 WebSocket 连接包装成 net.Conn，用于 NewConn
+func NewWebSocketConn(ws *websocket.Conn) net.Conn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				// 文本消息不是 DSTP 数据，忽略
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	// Conn 在写锁内写出数据包(包括 CLOSE)，这里的锁让 Close 发出的 WebSocket 关闭帧不会插在正在写出的数据包中间
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 不等待正在进行的 Write，对方不再读取时 Write 会一直阻塞
+// 有数据包正在写出时不发送关闭帧，直接关闭底层连接，阻塞的 Write 随之返回
+func (c *wsConn) Close() error {
+	if c.writeMtx.TryLock() {
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(closeWriteTimeout))
+		c.writeMtx.Unlock()
+	}
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// WebSocketHandler 把 HTTP 请求升级为 WebSocket，每个连接调用一次 accept
+// upgrader 为 nil 时使用默认配置(只接受同源请求)
+// accept 返回后连接不会被关闭，可以在 accept 中启动协程处理
+func WebSocketHandler(upgrader *websocket.Upgrader, accept func(conn net.Conn)) http.Handler {
+	if upgrader == nil {
+		upgrader = &websocket.Upgrader{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade 已经回复了错误
+			return
+		}
+		accept(NewWebSocketConn(ws))
+	})
+}
+
+// DialWebSocket 通过 WebSocket 连接 url(ws:// 或 wss://)，dialer 为 nil 时使用默认配置
+func DialWebSocket(ctx context.Context, url string, dialer *websocket.Dialer, opts ConnOptions) (*Conn, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewWebSocketConn(ws)
+	return NewConnWithOptions(&conn, opts), nil
+}
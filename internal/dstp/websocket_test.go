@@ -0,0 +1,103 @@
+package dstp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(WebSocketHandler(nil, func(conn net.Conn) {
+		go func() {
+			c := NewConn(&conn)
+			for {
+				data, type_, err := c.Receive()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if type_ != FrameMessage {
+					continue
+				}
+				if err := c.Send(data, false); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialWebSocket(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil, DefaultConnOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 40, 2*maxSegmentLen + 1} {
+		data := bytes.Repeat([]byte{'w'}, size)
+		if err := conn.Send(data, false); err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := conn.Receive()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("size %d: got %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	conn.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("server still receiving")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not notice close")
+	}
+}
+
+func TestWebSocketCloseBlockedWrite(t *testing.T) {
+	// 服务端不读取，客户端的 Write 阻塞时 Close 仍然立即返回
+	held := make(chan net.Conn, 1)
+	srv := httptest.NewServer(WebSocketHandler(nil, func(conn net.Conn) { held <- conn }))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialWebSocket(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil, DefaultConnOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (<-held).Close()
+
+	sent := make(chan error, 1)
+	go func() { sent <- conn.Send(make([]byte, 32<<20), false) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("send returned %v while the server is not reading", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked behind the stuck write")
+	}
+	if err := <-sent; err == nil {
+		t.Fatal("send succeeded after close")
+	}
+}
@@ -1,23 +1,33 @@
 package message_hub
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/EnderCHX/DSMS-go/internal/dstp"
 	auth "github.com/EnderCHX/DSMS-go/utils/jwt"
 	"github.com/EnderCHX/DSMS-go/utils/log"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var globMsg = make(chan struct {
-	data []byte
-	c    *client
+// StreamBulk 上按流接收的大块数据，由 hub 边收边转发
+var globStream = make(chan struct {
+	r *dstp.StreamReader
+	c *client
 }, 16)
 
 var clientCloseNotify = make(chan *client, 16)
@@ -42,13 +52,45 @@ type Hub struct {
 	server      *server
 }
 
+// HubOptions hub 配置
+type HubOptions struct {
+	TLS *tls.Config // 不为 nil 时只接受 TLS 连接，WebSocket 也使用 wss
+	// WebSocketAddr 不为空时在该地址的 /dstp 路径上接受 WebSocket 客户端，供浏览器中的观察者使用
+	WebSocketAddr string
+	// WebSocketOrigins 允许跨域连接 WebSocket 的来源，为空时只接受同源请求，"*" 表示接受所有来源
+	WebSocketOrigins []string
+	// UDPAddr 不为空时同时在该 UDP 地址上接受客户端，适合高频的状态更新
+	UDPAddr string
+	// StatsInterval 大于 0 时按该间隔在日志中输出每个客户端连接的统计信息
+	StatsInterval time.Duration
+	// TraceFrames 为 true 时在 debug 日志中记录每个客户端收发的每个数据包，用于排查线路上的问题
+	TraceFrames bool
+}
+
 func NewHub(addr, port string) *Hub {
-	listener, err := net.Listen("tcp", addr+":"+port)
+	return NewHubWithOptions(addr, port, HubOptions{})
+}
+
+func NewHubWithOptions(addr, port string, opts HubOptions) *Hub {
+	listener, err := dstp.Listen("tcp", addr+":"+port, opts.TLS)
 	InitLogger()
 	if err != nil {
 		logger.Error(err.Error())
 		return nil
 	}
+	var udp net.Listener
+	if opts.UDPAddr != "" {
+		udp, err = dstp.ListenUDP(opts.UDPAddr, dstp.UDPOptions{})
+		if err != nil {
+			logger.Error(err.Error())
+			listener.Close()
+			return nil
+		}
+	}
+	var ws *http.Server
+	if opts.WebSocketAddr != "" {
+		ws = newWebSocketServer(opts)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	h := &Hub{
 		subscribers: make(map[string]map[*client]struct{}),
@@ -59,9 +101,15 @@ func NewHub(addr, port string) *Hub {
 			mtx:       sync.Mutex{},
 			ctx:       ctx,
 			close:     cancel,
+			ws:        ws,
+			wsOrigins: opts.WebSocketOrigins,
+			udp:       udp,
+			stats:     opts.StatsInterval,
+			trace:     opts.TraceFrames,
 		},
 		mtx: sync.Mutex{},
 	}
+	h.server.handle = h.handleMsg
 	return h
 }
 
@@ -70,25 +118,14 @@ func (h *Hub) start() {
 	go h.server.start()
 	for {
 		select {
-		case msg := <-globMsg:
-			logger.Debug(fmt.Sprintf("%v -> msg: %s", msg.c.conn.RemoteAddr(), string(msg.data)))
-			var data Msg
-			err := json.Unmarshal(msg.data, &data)
-			if err != nil {
-				msg.c.send <- func() []byte {
-					msg_, _ := json.Marshal(&Msg{
-						Option: "error",
-						Data:   json.RawMessage(`{"msg":"message format error, need json"}`),
-					})
-					return msg_
-				}()
-				continue
-			}
-			go h.handleMsg(data, msg.c)
+		case stream := <-globStream:
+			go h.relayStream(stream.r, stream.c)
 		case msg := <-h.server.broadcast:
+			h.server.mtx.Lock()
 			for client := range h.server.clients {
-				client.send <- msg
+				client.push(msg, dstp.PriorityNormal)
 			}
+			h.server.mtx.Unlock()
 		}
 	}
 }
@@ -98,29 +135,69 @@ func (h *Hub) Run() {
 }
 
 type client struct {
-	username string
-	login    bool
+	username string      // 登录时在 login 之前设置
+	login    atomic.Bool // 其他客户端的处理协程也会读取
 	conn     *dstp.Conn
 	send     chan []byte
-	pong     chan struct{}
+	control  chan []byte // 控制优先级的转发消息，由单独的协程发出，可以在其他消息的分块之间插队
 	ctx      context.Context
 	close    context.CancelFunc
-	closed   bool
+	closed   atomic.Bool
 	mtx      sync.Mutex
+	dropped  atomic.Uint64 // 发送队列满时丢弃的转发消息数
+	handle   func(Msg, *client)
+}
+
+// 每个客户端的发送队列长度，转发的消息在队列满时丢弃，处理慢的客户端不会阻塞发布者
+// 队列由 Write 协程按 DSTP 流量控制的速度发出
+const sendQueueSize = 256
+
+// 控制消息(步长修改、移除节点等)的队列长度和使用的流，与普通消息分开发送
+const (
+	controlQueueSize = 64
+	controlStream    = 1
+)
+
+// 心跳由 DSTP keepalive 负责，连续 3 个周期没有 pong 则断开
+var keepalive = dstp.KeepaliveOptions{
+	Interval:  10 * time.Second,
+	MaxMissed: 3,
 }
 
-func newClient(conn *net.Conn) *client {
-	con := dstp.NewConn(conn)
+// 对外开放的 hub 限制单条消息大小和读取头部的时间，超出后断开连接
+// StreamBulk 上的大块数据边收边转发，不受单条消息大小限制
+var limits = dstp.Limits{
+	MaxMessageSize: 4 << 20,
+	MaxSegments:    64,
+	HeaderTimeout:  10 * time.Second,
+}
+
+// 转发的 JSON 消息较大时压缩，握手时不支持压缩的客户端不压缩
+var compression = dstp.CompressionOptions{
+	Codec:     dstp.DeflateCodec{Level: flate.BestSpeed},
+	Threshold: 512,
+}
+
+func clientOptions() dstp.ConnOptions {
+	opts := dstp.DefaultConnOptions()
+	opts.Keepalive = keepalive
+	opts.Limits = limits
+	opts.Compression = compression
+	opts.ReceiveStreams = []uint16{dstp.StreamBulk}
+	return opts
+}
+
+func newClient(conn *net.Conn, opts dstp.ConnOptions) *client {
+	con := dstp.NewConnWithOptions(conn, opts)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	return &client{
-		conn:   con,
-		send:   make(chan []byte),
-		ctx:    ctx,
-		close:  cancel,
-		mtx:    sync.Mutex{},
-		closed: false,
-		pong:   make(chan struct{}),
+		conn:    con,
+		send:    make(chan []byte, sendQueueSize),
+		control: make(chan []byte, controlQueueSize),
+		ctx:     ctx,
+		close:   cancel,
+		mtx:     sync.Mutex{},
 	}
 }
 
@@ -131,34 +208,69 @@ func (c *client) Read() {
 		}
 		defer c.Close()
 	}()
+	// 接收缓冲区在每次读取间复用，消息在下一次读取前解析完
+	var f dstp.Frame
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
-			data, type_, err := c.conn.Receive()
+			err := c.conn.ReceiveFrame(c.ctx, &f)
 			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
 				if err == io.EOF {
 					logger.Debug(fmt.Sprintf("%v -> disconnected", c.conn.RemoteAddr()))
 					c.Close()
 					return
 				}
+				if errors.Is(err, dstp.ErrChecksum) || errors.Is(err, dstp.ErrCompression) {
+					// 损坏的消息已被丢弃，需要应答的消息会由客户端重传
+					logger.Warn(fmt.Sprintf("%v -> %v", c.conn.RemoteAddr(), err))
+					continue
+				}
+				if errors.Is(err, dstp.ErrPeerDead) {
+					logger.Debug(fmt.Sprintf("%v -> timeout, remove", c.conn.RemoteAddr()))
+					c.Close()
+					return
+				}
 				logger.Error(fmt.Sprintf("%v -> read error: %v", c.conn.RemoteAddr(), err))
 				c.Close()
 				return
 			}
 
-			if type_ != 1 {
+			if f.Type == dstp.FrameStream {
+				globStream <- struct {
+					r *dstp.StreamReader
+					c *client
+				}{
+					r: f.Reader,
+					c: c,
+				}
+				continue
+			}
+			data := f.Payload
+			if f.Type != dstp.FrameMessage {
 				continue
 			}
 
-			globMsg <- struct {
-				data []byte
-				c    *client
-			}{
-				data: data,
-				c:    c,
+			logger.Debug(fmt.Sprintf("%v -> msg: %s", c.conn.RemoteAddr(), string(data)))
+			var msg Msg
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				c.reply(func() []byte {
+					msg_, _ := json.Marshal(&Msg{
+						Option: "error",
+						Data:   json.RawMessage(`{"msg":"message format error, need json"}`),
+					})
+					return msg_
+				}())
+				continue
 			}
+			msg.priority = f.Priority
+			// 在读取协程中依次处理，同一个客户端的消息按发送顺序生效，重连后先登录再订阅
+			c.handle(msg, c)
 		}
 	}
 }
@@ -180,66 +292,95 @@ func (c *client) Write() {
 	}
 }
 
-func (c *client) HeartBeat() {
+// push 把转发的消息按发布者设置的优先级放入发送队列，队列满时丢弃该消息
+func (c *client) push(msg []byte, priority dstp.Priority) bool {
+	queue := c.send
+	if priority > dstp.PriorityNormal {
+		queue = c.control
+	}
+	select {
+	case queue <- msg:
+		return true
+	default:
+	}
+	if dropped := c.dropped.Add(1); dropped == 1 || dropped%100 == 0 {
+		stats := c.conn.Stats()
+		logger.Warn(fmt.Sprintf("%v -> send queue full, %d messages dropped, %d waiting for ack, send window %d",
+			c.conn.RemoteAddr(), dropped, stats.PendingAcks, stats.SendWindow))
+	}
+	return false
+}
+
+// WriteControl 发出控制优先级的消息，和 Write 并行，DSTP 在普通消息的分块之间写出控制消息
+func (c *client) WriteControl() {
 	defer func() {
 		if err := recover(); err != nil {
-			logger.Error(fmt.Sprintf("%v -> heartbeat error: %v", c.conn.RemoteAddr(), err))
+			logger.Error(fmt.Sprintf("%v -> write error: %v", c.conn.RemoteAddr(), err))
 		}
-		defer c.Close()
 	}()
-	logintimeout := 50 * time.Second
-	heartbeatTime := 30 * time.Second
-	timeout := 40 * time.Second
-	loginTicker := time.NewTicker(logintimeout)
-	heartTicker := time.NewTicker(heartbeatTime)
-	timeoutTicker := time.NewTicker(timeout)
+	opts := dstp.SendOptions{NeedAck: true, Stream: controlStream, Priority: dstp.PriorityControl}
 	for {
 		select {
-		case <-heartTicker.C:
-			c.send <- func() []byte {
-				msg_, _ := json.Marshal(&Msg{
-					Option: "ping",
-				})
-				return msg_
-			}()
-			logger.Debug(fmt.Sprintf("ping -> %v", c.conn.RemoteAddr()))
-		case <-c.pong:
-			timeoutTicker.Reset(timeout)
-			logger.Debug(fmt.Sprintf("%v -> pong", c.conn.RemoteAddr()))
-		case <-timeoutTicker.C:
-			clientCloseNotify <- c
-			c.Close()
-			logger.Debug(fmt.Sprintf("%v -> timeout, remove", c.conn.RemoteAddr()))
+		case msg := <-c.control:
+			c.conn.SendWithOptions(msg, opts)
+		case <-c.ctx.Done():
 			return
-		case <-loginTicker.C:
-			if c.login {
-				loginTicker.Stop()
-			} else {
-				c.send <- func() []byte {
-					msg_, _ := json.Marshal(&Msg{
-						Option: "error",
-						Data:   json.RawMessage(`{"msg":"login timeout, please login"}`),
-					})
-					return msg_
-				}()
-				clientCloseNotify <- c
-				c.Close()
-				logger.Debug(fmt.Sprintf("%v -> login timeout, remove", c.conn.RemoteAddr()))
-				return
-			}
 		}
 	}
 }
 
+// LoginTimeout 连接后一段时间内没有登录则断开
+func (c *client) LoginTimeout() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(fmt.Sprintf("%v -> login timeout error: %v", c.conn.RemoteAddr(), err))
+		}
+	}()
+	loginTimer := time.NewTimer(50 * time.Second)
+	defer loginTimer.Stop()
+	select {
+	case <-c.ctx.Done():
+		return
+	case <-loginTimer.C:
+	}
+	if c.login.Load() {
+		return
+	}
+	c.reply(func() []byte {
+		msg_, _ := json.Marshal(&Msg{
+			Option: "error",
+			Data:   json.RawMessage(`{"msg":"login timeout, please login"}`),
+		})
+		return msg_
+	}())
+	clientCloseNotify <- c
+	c.Close()
+	logger.Debug(fmt.Sprintf("%v -> login timeout, remove", c.conn.RemoteAddr()))
+}
+
+// reply 把给这个客户端的回复放入发送队列，不等待发送
+// 回复在读取协程中产生，队列满时说明客户端不再读取，关闭连接而不是阻塞读取协程
+func (c *client) reply(msg []byte) {
+	select {
+	case c.send <- msg:
+	case <-c.ctx.Done():
+	default:
+		logger.Warn(fmt.Sprintf("%v -> send queue full, remove", c.conn.RemoteAddr()))
+		// 登录处理持有 c.mtx，在其他协程中关闭
+		go c.Close()
+	}
+}
+
 func (c *client) Close() {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	if c.closed {
+	if c.closed.Load() {
 		return
 	}
 	c.close()
-	c.closed = true
+	c.closed.Store(true)
 	c.conn.Close()
+	logger.Debug(fmt.Sprintf("%v -> closed, %s", c.conn.RemoteAddr(), formatStats(c.conn.Stats())))
 	clientCloseNotify <- c
 }
 
@@ -250,6 +391,12 @@ type server struct {
 	broadcast chan []byte
 	ctx       context.Context
 	close     context.CancelFunc
+	ws        *http.Server // WebSocket 监听，未启用时为 nil
+	wsOrigins []string
+	udp       net.Listener  // UDP 监听，未启用时为 nil
+	stats     time.Duration // 输出连接统计信息的间隔，0 表示不输出
+	trace     bool
+	handle    func(Msg, *client) // 处理客户端发来的消息，由 hub 设置
 }
 
 func (s *server) start() {
@@ -259,6 +406,17 @@ func (s *server) start() {
 		}
 		defer s.listen.Close()
 	}()
+	if s.ws != nil {
+		go s.startWebSocket()
+		defer s.ws.Close()
+	}
+	if s.udp != nil {
+		go s.startUDP()
+		defer s.udp.Close()
+	}
+	if s.stats > 0 {
+		go s.logStats()
+	}
 	go func() {
 		for {
 			select {
@@ -270,6 +428,8 @@ func (s *server) start() {
 				delete(s.clients, c)
 				s.mtx.Unlock()
 				go func() {
+					s.mtx.Lock()
+					defer s.mtx.Unlock()
 					logger.Debug(fmt.Sprintf("%v clients connected", len(s.clients)))
 					logger.Debug(fmt.Sprintf("%v", func() []net.Addr {
 						var addrs []net.Addr
@@ -292,43 +452,145 @@ func (s *server) start() {
 				logger.Error(fmt.Sprintf("%v -> accept error: %v", s.listen.Addr(), err))
 			}
 
-			client := newClient(&conn)
+			s.serve(conn)
+		}
+	}
+}
 
-			if _, ok := s.clients[client]; ok {
-				client.Close()
-				clientCloseNotify <- client
-				continue
-			}
+// logStats 定期输出每个客户端连接的统计信息
+func (s *server) logStats() {
+	ticker := time.NewTicker(s.stats)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
 			s.mtx.Lock()
-			s.clients[client] = struct{}{}
+			for client := range s.clients {
+				logger.Info(fmt.Sprintf("%v -> %s", client.conn.RemoteAddr(), formatStats(client.conn.Stats())))
+			}
 			s.mtx.Unlock()
+		}
+	}
+}
 
-			logger.Debug(fmt.Sprintf("%v -> connected", conn.RemoteAddr()))
-			logger.Debug(fmt.Sprintf("%v clients connected", len(s.clients)))
-			logger.Debug(fmt.Sprintf("%v", func() []net.Addr {
-				var addrs []net.Addr
-				for client := range s.clients {
-					addrs = append(addrs, client.conn.RemoteAddr())
-				}
-				return addrs
-			}()))
+// formatStats 把连接统计信息格式化为一行日志
+func formatStats(st dstp.Stats) string {
+	return fmt.Sprintf("sent %d bytes %v, received %d bytes %v, %d retransmits, ack latency %v, rtt %v, %d waiting for ack",
+		st.BytesSent, st.FramesSent, st.BytesReceived, st.FramesReceived,
+		st.Retransmits, st.SmoothedAckLatency, st.SmoothedRTT, st.PendingAcks)
+}
+
+// frameLogger 在 debug 日志中记录一个客户端连接上的每个数据包
+type frameLogger struct {
+	addr net.Addr
+}
+
+func (l frameLogger) OnFrameSent(f dstp.FrameInfo) {
+	logger.Debug(fmt.Sprintf("%v <- %v id=%d flags=%08b stream=%d segments=%d size=%d", l.addr, f.Type, f.Id, f.Flags, f.Stream, f.Segments, f.Size))
+}
+
+func (l frameLogger) OnFrameReceived(f dstp.FrameInfo) {
+	logger.Debug(fmt.Sprintf("%v -> %v id=%d flags=%08b stream=%d segments=%d size=%d", l.addr, f.Type, f.Id, f.Flags, f.Stream, f.Segments, f.Size))
+}
+
+func (l frameLogger) OnRetransmit(messageId uint32, attempt int) {
+	logger.Debug(fmt.Sprintf("%v <- retransmit id=%d attempt %d", l.addr, messageId, attempt))
+}
 
-			go client.Read()
-			go client.Write()
-			go client.HeartBeat()
+func (l frameLogger) OnAck(messageId uint32, latency time.Duration) {
+	logger.Debug(fmt.Sprintf("%v -> ack id=%d after %v", l.addr, messageId, latency))
+}
+
+// ServeConn 为已经建立的连接创建客户端并立即返回，客户端在后台按 hub 的协议处理
+// 用于 hub 没有监听的传输层，测试中可以传入 dstp.PipeConn 的一端，在进程内测试 hub 的逻辑
+func (h *Hub) ServeConn(conn net.Conn) {
+	h.server.serve(conn)
+}
+
+// serve 为新连接创建客户端，TCP 和 WebSocket 连接共用
+// WebSocket 连接在各自的 HTTP 协程中调用，访问 clients 需要加锁
+func (s *server) serve(conn net.Conn) {
+	s.serveOptions(conn, clientOptions())
+}
+
+func (s *server) serveOptions(conn net.Conn, opts dstp.ConnOptions) {
+	if s.trace {
+		opts.Tracer = frameLogger{addr: conn.RemoteAddr()}
+	}
+	client := newClient(&conn, opts)
+	client.handle = s.handle
+
+	s.mtx.Lock()
+	if _, ok := s.clients[client]; ok {
+		s.mtx.Unlock()
+		client.Close()
+		clientCloseNotify <- client
+		return
+	}
+	s.clients[client] = struct{}{}
+
+	logger.Debug(fmt.Sprintf("%v -> connected", conn.RemoteAddr()))
+	logger.Debug(fmt.Sprintf("%v clients connected", len(s.clients)))
+	logger.Debug(fmt.Sprintf("%v", func() []net.Addr {
+		var addrs []net.Addr
+		for client := range s.clients {
+			addrs = append(addrs, client.conn.RemoteAddr())
 		}
+		return addrs
+	}()))
+	s.mtx.Unlock()
+
+	go client.Read()
+	go client.Write()
+	go client.WriteControl()
+	go client.LoginTimeout()
+}
+
+// startWebSocket 在 TCP 监听之外接受 WebSocket 客户端
+func (s *server) startWebSocket() {
+	s.ws.Handler = dstpHandler(s)
+	var err error
+	if s.ws.TLSConfig != nil {
+		err = s.ws.ListenAndServeTLS("", "")
+	} else {
+		err = s.ws.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(fmt.Sprintf("%v -> websocket error: %v", s.ws.Addr, err))
 	}
 }
 
 type Msg struct {
 	Option string          `json:"option"`
 	Data   json.RawMessage `json:"data"`
+
+	priority dstp.Priority // 发布者发送这条消息时的优先级，转发时沿用
+}
+
+// topicSubscribers 返回 topic 上已经登录的订阅者，同时移除已经关闭的订阅者
+func (h *Hub) topicSubscribers(topic string) []*client {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var subscribers []*client
+	for client := range h.subscribers[topic] {
+		if client.closed.Load() {
+			logger.Debug(fmt.Sprintf("%v -> client closed", client.conn.RemoteAddr()))
+			delete(h.subscribers[topic], client)
+			continue
+		}
+		if client.login.Load() {
+			subscribers = append(subscribers, client)
+		}
+	}
+	return subscribers
 }
 
 func (h *Hub) handleMsg(msg Msg, c *client) {
 	switch msg.Option {
 	case "subscribe":
-		if !c.login {
+		if !c.login.Load() {
 			return
 		}
 		type Data struct {
@@ -346,7 +608,7 @@ func (h *Hub) handleMsg(msg Msg, c *client) {
 		}
 		h.subscribers[data.Topic][c] = struct{}{}
 	case "unsubscribe":
-		if !c.login {
+		if !c.login.Load() {
 			return
 		}
 		type Data struct {
@@ -365,7 +627,7 @@ func (h *Hub) handleMsg(msg Msg, c *client) {
 		}
 		delete(h.subscribers[data.Topic], c)
 	case "publish":
-		if !c.login {
+		if !c.login.Load() {
 			return
 		}
 		type Data struct {
@@ -382,21 +644,11 @@ func (h *Hub) handleMsg(msg Msg, c *client) {
 		data_, _ := json.Marshal(data)
 		msg.Data = data_
 		msg_, _ := json.Marshal(msg)
-		for client := range h.subscribers[data.Topic] {
-			if client.closed {
-				logger.Debug(fmt.Sprintf("%v -> client closed", client.conn.RemoteAddr()))
-				client.mtx.Lock()
-				delete(h.subscribers[data.Topic], client)
-				client.mtx.Unlock()
-				continue
-			}
-			if !client.login {
-				continue
-			}
-			client.send <- msg_
+		for _, client := range h.topicSubscribers(data.Topic) {
+			client.push(msg_, msg.priority)
 		}
 	case "pong":
-		c.pong <- struct{}{}
+		// 心跳已由 DSTP keepalive 负责，忽略旧客户端的 pong
 	case "login":
 		type Data struct {
 			AccessToken string `json:"access_token"`
@@ -404,61 +656,235 @@ func (h *Hub) handleMsg(msg Msg, c *client) {
 		var data Data
 		json.Unmarshal(msg.Data, &data)
 		if data.AccessToken == "" {
-			c.send <- func() []byte {
+			c.reply(func() []byte {
 				msg_, _ := json.Marshal(&Msg{
 					Option: "error",
 					Data:   json.RawMessage(`{"error":"access token is empty"}`),
 				})
 				logger.Debug(fmt.Sprintf("%v -> : %v", c.conn.RemoteAddr(), "登录失败"))
 				return msg_
-			}()
+			}())
 			return
 		} else {
 			payload, err := auth.VerifyToken(data.AccessToken, os.Getenv("ACCESS_SECRET"))
 			if err != nil {
-				c.send <- func() []byte {
+				c.reply(func() []byte {
 					msg_, _ := json.Marshal(&Msg{
 						Option: "error",
 						Data:   json.RawMessage(`{"error":"access token is invalid"}`),
 					})
 					return msg_
-				}()
+				}())
 				return
 			} else {
 				c.mtx.Lock()
 				defer c.mtx.Unlock()
-				if c.login {
-					c.send <- func() []byte {
+				if c.login.Load() {
+					c.reply(func() []byte {
 						msg_, _ := json.Marshal(&Msg{
 							Option: "error",
 							Data:   json.RawMessage(`{"error":"already login"}`),
 						})
 						return msg_
-					}()
+					}())
 					return
 				} else {
-					c.login = true
 					c.username = payload.Username
-					c.send <- func() []byte {
+					c.login.Store(true)
+					c.reply(func() []byte {
 						msg_, _ := json.Marshal(&Msg{
 							Option: "info",
 							Data:   json.RawMessage(`{"info":"login success"}`),
 						})
 						logger.Debug(fmt.Sprintf("%v -> : %v", c.conn.RemoteAddr(), "登录成功"))
 						return msg_
-					}()
+					}())
 					return
 				}
 			}
 		}
 	default:
 		logger.Error(fmt.Sprintf("%v -> unknown option: %v", c.conn.RemoteAddr(), msg.Option))
-		c.send <- func() []byte {
+		c.reply(func() []byte {
 			msg_, _ := json.Marshal(&Msg{
 				Option: "error",
 				Data:   json.RawMessage(`{"error":"unknown option"}`),
 			})
 			return msg_
+		}())
+	}
+}
+
+// 大块数据开头 JSON 头的最大长度
+const streamHeaderLimit = 4 << 10
+
+// relayStream 把客户端在 StreamBulk 上发送的大块数据(场景文件、录像等)转发给订阅者，不缓存整条消息
+// 数据以一行 JSON 头开始: {"topic":"..."}\n，之后是原始数据，转发时头部加上 from_user
+// 每个订阅者有单独的队列，转发按最慢的订阅者放慢，hub 不再读取时发布者按流的信用等待，不影响连接上的其他消息
+// relayTimeout 内没有腾出队列或发送失败的订阅者被跳过
+// 只转发给握手协商出 CapStreams 的订阅者，其他订阅者需要整条消息，转发前要缓存整个上传，这些订阅者被跳过
+func (h *Hub) relayStream(r *dstp.StreamReader, c *client) {
+	defer r.Close()
+	br := bufio.NewReaderSize(r, streamHeaderLimit)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%v -> bad stream header: %v", c.conn.RemoteAddr(), err))
+		return
+	}
+	var header struct {
+		Topic    string `json:"topic"`
+		FromUser string `json:"from_user"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil || header.Topic == "" || !c.login.Load() {
+		return
+	}
+	header.FromUser = c.username
+	head, _ := json.Marshal(header)
+	head = append(head, '\n')
+
+	subscribers := h.topicSubscribers(header.Topic)
+
+	out := &fanout{}
+	for _, client := range subscribers {
+		if f, ok := client.conn.Features(); !ok || !f.Capabilities.Has(dstp.CapStreams) {
+			logger.Debug(fmt.Sprintf("%v -> skip stream on %s, no stream support", client.conn.RemoteAddr(), header.Topic))
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		q := &relayQueue{chunks: make(chan []byte, relayQueueSize), done: make(chan struct{}), cancel: cancel}
+		out.queues = append(out.queues, q)
+		go func() {
+			defer close(q.done)
+			defer cancel()
+			opts := dstp.SendOptions{Stream: dstp.StreamBulk, Priority: dstp.PriorityBulk}
+			if _, err := client.conn.SendReader(ctx, io.MultiReader(bytes.NewReader(head), q), opts); err != nil {
+				logger.Debug(fmt.Sprintf("%v -> stream on %s not relayed: %v", client.conn.RemoteAddr(), header.Topic, err))
+			}
 		}()
 	}
+	relayed := len(out.queues)
+	n, err := io.Copy(out, br)
+	out.close(err)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%v -> stream on %s interrupted after %d bytes: %v", c.conn.RemoteAddr(), header.Topic, n, err))
+		return
+	}
+	logger.Debug(fmt.Sprintf("%v -> stream on %s, %d bytes to %d subscribers", c.conn.RemoteAddr(), header.Topic, n, relayed))
+}
+
+// 转发大块数据时每个订阅者最多排队的数据块数，每块不超过 streamHeaderLimit
+const relayQueueSize = 64
+
+// 转发大块数据时等待一个订阅者腾出队列的最长时间，超时的订阅者被跳过
+const relayTimeout = 10 * time.Second
+
+var errSlowSubscriber = errors.New("subscriber too slow")
+
+// relayQueue 一个订阅者待发送的数据，由订阅者连接的 SendReader 读取
+type relayQueue struct {
+	chunks chan []byte
+	cur    []byte
+	err    error              // chunks 关闭前设置，nil 表示数据完整
+	done   chan struct{}      // SendReader 返回后关闭
+	cancel context.CancelFunc // 中断 SendReader，等待对方信用时也会返回
+}
+
+func (q *relayQueue) Read(p []byte) (int, error) {
+	for len(q.cur) == 0 {
+		chunk, ok := <-q.chunks
+		if !ok {
+			if q.err != nil {
+				return 0, q.err
+			}
+			return 0, io.EOF
+		}
+		q.cur = chunk
+	}
+	n := copy(p, q.cur)
+	q.cur = q.cur[n:]
+	return n, nil
+}
+
+// put 等待队列容纳 chunk，订阅者已经停止发送或 relayTimeout 内没有腾出空间时中断转发并返回 false
+func (q *relayQueue) put(chunk []byte) bool {
+	select {
+	case q.chunks <- chunk:
+		return true
+	default:
+	}
+	timer := time.NewTimer(relayTimeout)
+	defer timer.Stop()
+	select {
+	case q.chunks <- chunk:
+		return true
+	case <-q.done:
+	case <-timer.C:
+	}
+	q.close(errSlowSubscriber)
+	q.cancel()
+	return false
+}
+
+func (q *relayQueue) close(err error) {
+	q.err = err
+	close(q.chunks)
+}
+
+// fanout 把数据依次放入每个订阅者的队列，等待最慢的订阅者，超时的订阅者被移除
+type fanout struct {
+	queues []*relayQueue
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	chunk := slices.Clone(p)
+	f.queues = slices.DeleteFunc(f.queues, func(q *relayQueue) bool {
+		return !q.put(chunk)
+	})
+	return len(p), nil
+}
+
+// close 结束转发，err 不为 nil 时订阅者收到的消息不完整
+func (f *fanout) close(err error) {
+	for _, q := range f.queues {
+		q.close(err)
+	}
+}
+
+// startUDP 接受 UDP 客户端，数据报可能丢失或损坏，解析时跳过损坏的数据包
+func (s *server) startUDP() {
+	opts := clientOptions()
+	opts.Resync = true
+	for {
+		conn, err := s.udp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error(fmt.Sprintf("%v -> udp accept error: %v", s.udp.Addr(), err))
+			}
+			return
+		}
+		s.serveOptions(conn, opts)
+	}
+}
+
+func newWebSocketServer(opts HubOptions) *http.Server {
+	return &http.Server{
+		Addr:      opts.WebSocketAddr,
+		TLSConfig: opts.TLS,
+		// Handler 在启动时设置
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// dstpHandler 在 /dstp 路径上把 WebSocket 连接交给 hub
+func dstpHandler(s *server) http.Handler {
+	upgrader := &websocket.Upgrader{}
+	if len(s.wsOrigins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || slices.Contains(s.wsOrigins, "*") || slices.Contains(s.wsOrigins, origin)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dstp", dstp.WebSocketHandler(upgrader, s.serve))
+	return mux
 }
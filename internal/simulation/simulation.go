@@ -2,7 +2,7 @@ package simulation
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/data/binding"
@@ -20,12 +20,14 @@ import (
 	"image/color"
 	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 var (
-	dstpConn           *dstp.Conn
+	msgClient          *dstp.Client
+	connState                        = binding.NewString()
 	vectorClock                      = sync.Map{}
 	tick               time.Duration = 20
 	tickBinding                      = binding.NewString()
@@ -40,6 +42,9 @@ var (
 	ctx, cancel        = context.WithCancel(context.Background())
 )
 
+// 步长修改、移除节点等控制消息走单独的流，可以在位置更新等消息的分块之间插队
+var controlSend = dstp.SendOptions{Stream: 1, Priority: dstp.PriorityControl}
+
 type Point struct {
 	X, Y     float64
 	Username string
@@ -253,14 +258,46 @@ func connectMsgHub(addr, port, username, password string) error {
 		return err
 	}
 
-	c, err := net.Dial("tcp", fmt.Sprintf("%v:%v", addr, port))
+	// 设置 DSTP_TLS 时使用 TLS 连接，见 dstp.TLSOptionsFromEnv
+	var tlsConfig *tls.Config
+	if tlsOpts, ok := dstp.TLSOptionsFromEnv(); ok {
+		tlsConfig, err = dstp.ClientTLSConfig(tlsOpts)
+		if err != nil {
+			logger.Error("dstp tls config failed", zap.Error(err))
+			return err
+		}
+	}
+
+	// 每次重连都重新建立连接并握手
+	dial := func(ctx context.Context) (*dstp.Conn, error) {
+		hsCtx, hsCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer hsCancel()
+		var conn *dstp.Conn
+		var err error
+		if os.Getenv("DSTP_UDP") != "" {
+			// 位置更新每个 tick 都会被新的覆盖，走 UDP 避免队头阻塞，需要应答的消息由 DSTP 重传
+			conn, err = dstp.DialUDP(hsCtx, net.JoinHostPort(addr, port), dstp.UDPOptions{}, dstp.DefaultConnOptions())
+		} else {
+			conn, err = dstp.DialContext(hsCtx, "tcp", net.JoinHostPort(addr, port), tlsConfig, dstp.DefaultConnOptions())
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Handshake(hsCtx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	msgClient, err = dstp.DialClient(context.Background(), dstp.ClientOptions{
+		Dial:          dial,
+		OnStateChange: onConnState,
+	})
 	if err != nil {
 		logger.Error("dstp failed", zap.Error(err))
 		return err
 	}
 
-	dstpConn = dstp.NewConn(&c)
-
 	loginByte, _ := sonic.Marshal(map[string]any{
 		"option": "login",
 		"data": map[string]any{
@@ -268,14 +305,46 @@ func connectMsgHub(addr, port, username, password string) error {
 		},
 	})
 
-	dstpConn.Send(loginByte, true)
+	// 登录消息在重连后自动重发
+	msgClient.SetSession("login", loginByte)
 
 	return nil
 }
 
+// onConnState 在界面上显示连接状态
+func onConnState(state dstp.ClientState, err error) {
+	var text string
+	switch state {
+	case dstp.ClientConnecting:
+		text = "连接中"
+	case dstp.ClientConnected:
+		text = "已连接"
+	case dstp.ClientReconnecting:
+		text = "重连中"
+	case dstp.ClientClosed:
+		text = "已断开"
+	}
+	if err != nil {
+		logger.Warn("dstp connection", zap.Stringer("state", state), zap.Error(err))
+		text += ": " + err.Error()
+	}
+	connState.Set(text)
+}
+
+// subscribe 订阅主题，重连后自动重新订阅
+func subscribe(topic string, msg []byte) {
+	msgClient.SetSession("subscribe:"+topic, msg)
+}
+
+// unsubscribe 取消订阅，重连后不再重新订阅
+func unsubscribe(topic string, msg []byte) {
+	msgClient.DeleteSession("subscribe:" + topic)
+	msgClient.Send(msg, dstp.SendOptions{})
+}
+
 func disconnectMsgHub() {
-	dstpConn.Close()
-	dstpConn = nil
+	msgClient.Close()
+	msgClient = nil
 	vectorClock.Clear()
 	logger.Debug("disconnect")
 }
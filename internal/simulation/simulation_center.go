@@ -10,6 +10,7 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
+	"github.com/EnderCHX/DSMS-go/internal/dstp"
 	"github.com/EnderCHX/DSMS-go/utils/log"
 	"github.com/bytedance/sonic"
 	"github.com/bytedance/sonic/ast"
@@ -104,6 +105,10 @@ func RunCenter() {
 					Text: "当前节点数量",
 				},
 				widget.NewLabelWithData(clientsCount),
+				&widget.Label{
+					Text: "连接状态",
+				},
+				widget.NewLabelWithData(connState),
 				tickInput,
 				&widget.Button{
 					Text: "修改步长(tick/s)",
@@ -128,7 +133,17 @@ func RunCenter() {
 								},
 							},
 						})
-						dstpConn.Send(msg, false)
+						go func() {
+							sendCtx, sendCancel := context.WithTimeout(ctx, 20*time.Second)
+							defer sendCancel()
+							err := msgClient.SendAndWait(sendCtx, msg, controlSend)
+							if err != nil {
+								logger.Error("修改步长未送达", zap.Error(err))
+								fyne.Do(func() {
+									dialog.NewInformation("错误", "修改步长未送达消息中心", w).Show()
+								})
+							}
+						}()
 					},
 				},
 				chatInput,
@@ -151,7 +166,7 @@ func RunCenter() {
 								},
 							},
 						})
-						dstpConn.Send(msg, false)
+						msgClient.Send(msg, dstp.SendOptions{})
 
 						chatInput.SetText("")
 					},
@@ -216,7 +231,7 @@ func RunCenter() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/join", msg)
 
 				vectorClockAdd(username.Text)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -228,7 +243,7 @@ func RunCenter() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/quit", msg)
 
 				vectorClockAdd(username.Text)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -240,7 +255,7 @@ func RunCenter() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/chat", msg)
 
 				vectorClockAdd(username.Text)
 				go step()
@@ -284,20 +299,23 @@ func step() {
 }
 
 func handleMsgCenter() {
+	// 退出时 msgClient 和 ctx 会被替换，这里使用启动时的值
+	client := msgClient
+	ctx := ctx
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			data_, type_, err := dstpConn.Receive()
+			// 断线期间 Receive 等待重连，客户端关闭后返回错误
+			data_, err := client.Receive(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
 				logger.Error("receive failed", zap.Error(err))
 				return
 			}
-			if type_ != 1 {
-				logger.Warn("invalid message type")
-				continue
-			}
 			logger.Debug(fmt.Sprintf("receive: %v", string(data_)))
 			option, _ := sonic.Get(data_, "option")
 			optionStr, _ := option.String()
@@ -307,7 +325,7 @@ func handleMsgCenter() {
 					msg, _ := sonic.Marshal(map[string]any{
 						"option": "pong",
 					})
-					dstpConn.Send(msg, false)
+					client.Send(msg, dstp.SendOptions{})
 				}()
 				continue
 			}
@@ -354,7 +372,7 @@ func handleEventCenter(topic string, data ast.Node) {
 				},
 			},
 		})
-		dstpConn.Send(msg, false)
+		subscribe("simulation/client/"+username, msg)
 
 		msg, _ = sonic.Marshal(map[string]any{
 			"option": "publish",
@@ -366,7 +384,7 @@ func handleEventCenter(topic string, data ast.Node) {
 				},
 			},
 		})
-		dstpConn.Send(msg, false)
+		msgClient.Send(msg, controlSend)
 	case "simulation/quit":
 		username, _ := data.Get("from_user").String()
 		clientsSet.Delete(username)
@@ -383,7 +401,7 @@ func handleEventCenter(topic string, data ast.Node) {
 				},
 			},
 		})
-		dstpConn.Send(msg, false)
+		unsubscribe("simulation/client/"+username, msg)
 
 		vectorClockAdd(centerUsername)
 		msg, _ = sonic.Marshal(map[string]any{
@@ -396,7 +414,7 @@ func handleEventCenter(topic string, data ast.Node) {
 				},
 			},
 		})
-		dstpConn.Send(msg, false)
+		msgClient.Send(msg, controlSend)
 	default:
 		if match, err := regexp.MatchString(`^simulation/client/(.+)$`, topic); err == nil && match {
 			username := topic[len("simulation/client/"):]
@@ -438,7 +456,7 @@ func handleEventCenter(topic string, data ast.Node) {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				msgClient.Send(msg, dstp.SendOptions{})
 
 			}
 			return
@@ -10,6 +10,7 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
+	"github.com/EnderCHX/DSMS-go/internal/dstp"
 	"github.com/EnderCHX/DSMS-go/utils/log"
 	"github.com/bytedance/sonic"
 	"github.com/bytedance/sonic/ast"
@@ -135,7 +136,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				msgClient.Send(msg, dstp.SendOptions{})
 
 				point, _ := clientsPoint.Load(clientUsername)
 
@@ -153,7 +154,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				msgClient.Send(msg, dstp.SendOptions{})
 
 				vectorClockAdd(clientUsername)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -165,7 +166,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/setting/tick", msg)
 
 				vectorClockAdd(clientUsername)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -177,7 +178,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/setting/point", msg)
 
 				vectorClockAdd(clientUsername)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -189,7 +190,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/setting/remove_point", msg)
 
 				vectorClockAdd(clientUsername)
 				msg, _ = sonic.Marshal(map[string]any{
@@ -201,7 +202,7 @@ func RunClient() {
 						},
 					},
 				})
-				dstpConn.Send(msg, false)
+				subscribe("simulation/chat", msg)
 
 				go clientStep()
 				go handleMsgClient()
@@ -226,6 +227,10 @@ func RunClient() {
 					Text: "当前步长:",
 				},
 				widget.NewLabelWithData(tickBinding),
+				&widget.Label{
+					Text: "连接状态:",
+				},
+				widget.NewLabelWithData(connState),
 				clientStepLenInput,
 				&widget.Button{
 					Text: "设置每次移动距离",
@@ -258,7 +263,7 @@ func RunClient() {
 								},
 							},
 						})
-						dstpConn.Send(msg, false)
+						msgClient.Send(msg, dstp.SendOptions{})
 
 						chatInput.SetText("")
 					},
@@ -273,7 +278,7 @@ func RunClient() {
 							"topic": "simulation/quit",
 						},
 					})
-					dstpConn.Send(msg, false)
+					msgClient.Send(msg, dstp.SendOptions{})
 					cancel()
 					disconnectMsgHub()
 					clientsPoint.Range(func(key, value any) bool {
@@ -328,7 +333,7 @@ func clientStep() {
 					},
 				},
 			})
-			dstpConn.Send(msg, false)
+			msgClient.Send(msg, dstp.SendOptions{})
 
 			fyne.Do(func() {
 				bigMap.points = clientsPoint
@@ -352,20 +357,23 @@ func clientStep() {
 }
 
 func handleMsgClient() {
+	// 退出时 msgClient 和 ctx 会被替换，这里使用启动时的值
+	client := msgClient
+	ctx := ctx
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			data_, type_, err := dstpConn.Receive()
+			// 断线期间 Receive 等待重连，客户端关闭后返回错误
+			data_, err := client.Receive(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
 				logger.Error("receive failed", zap.Error(err))
 				return
 			}
-			if type_ != 1 {
-				logger.Warn("invalid message type")
-				continue
-			}
 			option, _ := sonic.Get(data_, "option")
 			optionStr, _ := option.String()
 
@@ -374,7 +382,7 @@ func handleMsgClient() {
 					msg, _ := sonic.Marshal(map[string]any{
 						"option": "pong",
 					})
-					dstpConn.Send(msg, false)
+					client.Send(msg, dstp.SendOptions{})
 				}()
 				continue
 			}
@@ -462,5 +470,5 @@ func clientMove(move_x, move_y float64) {
 			},
 		},
 	})
-	dstpConn.Send(msg, false)
+	msgClient.Send(msg, dstp.SendOptions{})
 }
@@ -2,88 +2,66 @@ package test
 
 import (
 	"github.com/EnderCHX/DSMS-go/internal/dstp"
-	"net"
 	"testing"
 	"time"
 )
 
-func TestDSTPs(t *testing.T) {
-	listener, err := net.Listen("tcp", "0.0.0.0:20252")
-	if err != nil {
-		t.Error(err.Error())
-	}
-	tcpConn, err := listener.Accept()
-	if err != nil {
-		t.Error(err.Error())
-	}
-	dstpConn := dstp.NewConn(&tcpConn)
-	data, _, err := dstpConn.Receive()
-	if err != nil {
-		t.Error(err.Error())
-	}
-	t.Log(data)
-	t.Log(string(data))
-	err = dstpConn.Send(data, true)
-	if err != nil {
-		t.Error(err.Error())
-	}
-	time.Sleep(1 * time.Second)
-	dstpConn.Close()
-}
+func TestDSTPEcho(t *testing.T) {
+	server, client := dstp.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		data, _, err := server.Receive()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		t.Log(data)
+		t.Log(string(data))
+		err = server.Send(data, true)
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
 
-func TestDSTPc(t *testing.T) {
-	conn, err := net.Dial("tcp", "127.0.0.1:20252")
-	if err != nil {
-		t.Error(err.Error())
-	}
-	dstpConn := dstp.NewConn(&conn)
-	err = dstpConn.Send([]byte("hello"), true)
+	err := client.Send([]byte("hello"), true)
 	if err != nil {
 		t.Error(err.Error())
 	}
 	for {
-		data, type_, err := dstpConn.Receive()
+		data, type_, err := client.Receive()
 		if err != nil {
-			t.Error(err.Error())
+			t.Fatal(err.Error())
 		}
-		if type_ != 1 {
+		if type_ != dstp.FrameMessage {
 			continue
 		}
 		t.Log(data)
 		t.Log(string(data))
+		if string(data) != "hello" {
+			t.Errorf("got %q", data)
+		}
 		break
 	}
 }
 
-func TestDSTPPing(t *testing.T) {
-	listener, err := net.Listen("tcp", "0.0.0.0:20256")
-	if err != nil {
-		t.Error(err.Error())
-	}
-	tcpConn, err := listener.Accept()
-	if err != nil {
-		t.Error(err.Error())
-	}
-	dstpConn := dstp.NewConn(&tcpConn)
-	_, type_, err := dstpConn.Receive()
-	if err != nil {
-		t.Error(err.Error())
-	}
-	t.Log(type_)
-	dstpConn.Close()
-}
-
 func TestDSTPDelay(t *testing.T) {
-	conn, err := net.Dial("tcp", "127.0.0.1:20256")
-	if err != nil {
-		t.Error(err.Error())
-	}
-	dstpConn := dstp.NewConn(&conn)
+	server, client := dstp.PipeWithOptions(dstp.PipeOptions{Latency: 10 * time.Millisecond}, dstp.DefaultConnOptions())
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		// 收到 ping 时自动回复 pong
+		server.Receive()
+	}()
+
 	timeNow := time.Now()
-	dstpConn.Ping()
-	_, type_, err := dstpConn.Receive()
+	client.Ping()
+	_, type_, err := client.Receive()
 	if err != nil {
 		t.Error(err.Error())
 	}
+	if type_ != dstp.FramePong {
+		t.Errorf("got %v", type_)
+	}
 	t.Log(time.Since(timeNow), type_)
 }
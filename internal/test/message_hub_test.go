@@ -1,138 +1,345 @@
 package test
 
 import (
-	"github.com/EnderCHX/DSMS-go/internal/auth"
-	"github.com/EnderCHX/DSMS-go/internal/dstp"
-	"github.com/bytedance/sonic"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"net"
+	"os"
 	"sync"
-	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/EnderCHX/DSMS-go/internal/dstp"
+	"github.com/EnderCHX/DSMS-go/internal/message_hub"
+	auth "github.com/EnderCHX/DSMS-go/utils/jwt"
 )
 
-var msgTest, _ = sonic.Marshal(map[string]any{
-	"option": "publish",
-	"data": map[string]any{
-		"topic": "test",
-		"data":  "hello",
-	},
-})
+// 测试用的 token 签名密钥，hub 从 ACCESS_SECRET 读取
+const testSecret = "message-hub-test"
 
-var subTest, _ = sonic.Marshal(map[string]any{
-	"option": "subscribe",
-	"data": map[string]any{
-		"topic": "test",
-	},
+// hub 的消息通道是包级变量，同一进程内只启动一个 hub，客户端通过 ServeConn 接入
+var testHub = sync.OnceValue(func() *message_hub.Hub {
+	os.Setenv("ACCESS_SECRET", testSecret)
+	hub := message_hub.NewHub("127.0.0.1", "0")
+	hub.Run()
+	return hub
 })
 
-var access_token = func() string {
-	username := "test"
-	password := "test"
-	_, access_token, err := auth.Login(username, password)
+type hubMsg struct {
+	Option string `json:"option"`
+	Data   struct {
+		Topic    string          `json:"topic"`
+		Data     json.RawMessage `json:"data"`
+		FromUser string          `json:"from_user"`
+	} `json:"data"`
+}
+
+// connectHub 通过内存管道接入 hub，不登录
+func connectHub(t *testing.T) *dstp.Conn {
+	t.Helper()
+	a, b := dstp.PipeConn(dstp.PipeOptions{})
+	testHub().ServeConn(a)
+	conn := dstp.NewConn(&b)
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+// loginHub 接入 hub 并以 username 登录
+func loginHub(t *testing.T, username string) *dstp.Conn {
+	t.Helper()
+	conn := connectHub(t)
+	login(t, conn, username)
+	return conn
+}
+
+// streamHub 接入 hub，握手后以 username 登录，hub 向这个连接按流转发大块数据
+func streamHub(t *testing.T, username string) *dstp.Conn {
+	t.Helper()
+	conn := connectHub(t)
+	handshakeHub(t, conn)
+	login(t, conn, username)
+	return conn
+}
+
+func handshakeHub(t *testing.T, conn *dstp.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := conn.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func login(t *testing.T, conn *dstp.Conn, username string) {
+	t.Helper()
+	token, err := auth.GetToken(username, "user", "", "", testSecret, time.Hour)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	return access_token
-}()
+	sendHub(t, conn, "login", map[string]any{"access_token": token})
+	if msg := receiveHub(t, conn); msg.Option != "info" {
+		t.Fatalf("login %s: got %q", username, msg.Option)
+	}
+}
 
-var login, _ = sonic.Marshal(map[string]any{
-	"option": "login",
-	"data": map[string]any{
-		"access_token": access_token,
-	},
-})
+func sendHub(t *testing.T, conn *dstp.Conn, option string, data any) {
+	t.Helper()
+	msg, _ := json.Marshal(map[string]any{"option": option, "data": data})
+	if err := conn.Send(msg, true); err != nil {
+		t.Fatal(err)
+	}
+}
 
-func TestSend(t *testing.T) {
-	conn, err := net.Dial("tcp", "127.0.0.1:1314")
-	if err != nil {
-		t.Error(err)
+// receiveHub 接收下一条 hub 消息
+func receiveHub(t *testing.T, conn *dstp.Conn) hubMsg {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		data, type_, err := conn.ReceiveContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if type_ != dstp.FrameMessage {
+			continue
+		}
+		var msg hubMsg
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("bad message %q: %v", data, err)
+		}
+		return msg
+	}
+}
+
+// subscribeHub 订阅 topic，返回前确认订阅已经生效
+// 订阅没有回复，这里重复发布探测消息直到自己收到
+func subscribeHub(t *testing.T, conn *dstp.Conn, topic string) {
+	t.Helper()
+	sendHub(t, conn, "subscribe", map[string]any{"topic": topic})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			msg, _ := json.Marshal(map[string]any{"option": "publish", "data": map[string]any{"topic": topic, "data": "probe"}})
+			conn.Send(msg, false)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	for {
+		if msg := receiveHub(t, conn); msg.Option == "publish" && msg.Data.Topic == topic {
+			return
+		}
+	}
+}
+
+// receivePublished 接收 n 条 from 在 topic 上发布的消息，忽略探测消息
+func receivePublished(t *testing.T, conn *dstp.Conn, topic, from string, n int) {
+	t.Helper()
+	for got := 0; got < n; {
+		msg := receiveHub(t, conn)
+		if msg.Option != "publish" || msg.Data.Topic != topic || msg.Data.FromUser != from {
+			continue
+		}
+		if string(msg.Data.Data) != `"hello"` {
+			t.Fatalf("got %s", msg.Data.Data)
+		}
+		got++
+	}
+}
+
+func TestHubLoginRejected(t *testing.T) {
+	conn := connectHub(t)
+	sendHub(t, conn, "login", map[string]any{"access_token": "invalid"})
+	if msg := receiveHub(t, conn); msg.Option != "error" {
+		t.Fatalf("got %q, want error", msg.Option)
 	}
-	dstpConn := dstp.NewConn(&conn)
-	dstpConn.Send(login, true)
-	wg := &sync.WaitGroup{}
+}
+
+func TestHubPublish(t *testing.T) {
+	sub := loginHub(t, "subscriber")
+	pub := loginHub(t, "publisher")
+	subscribeHub(t, sub, "test/publish")
+
+	const n = 1000
+	msg, _ := json.Marshal(map[string]any{"option": "publish", "data": map[string]any{"topic": "test/publish", "data": "hello"}})
 	start := time.Now()
-	for i := 0; i < 10000; i++ {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
 		wg.Add(1)
 		go func() {
-			dstpConn.Send(msgTest, true)
-			wg.Done()
+			defer wg.Done()
+			if err := pub.Send(msg, true); err != nil {
+				t.Error(err)
+			}
 		}()
 	}
+	receivePublished(t, sub, "test/publish", "publisher", n)
 	wg.Wait()
-	t.Log("sent", 10000, "messages", "in", time.Since(start))
-	time.Sleep(time.Second * 20)
-	dstpConn.Close()
+	t.Log("relayed", n, "messages in", time.Since(start))
 }
 
-func TestReceive(t *testing.T) {
-	conn, err := net.Dial("tcp", "127.0.0.1:1314")
-	if err != nil {
-		t.Error(err)
-	}
-	dstpConn := dstp.NewConn(&conn)
-	dstpConn.Send(login, true)
-	time.Sleep(time.Second)
-	dstpConn.Send(subTest, true)
-	var timeCount time.Time
-	once := sync.Once{}
-	count := atomic.Uint64{}
-	t.Log("receiving")
+func TestHubFanout(t *testing.T) {
+	pub := loginHub(t, "fanout-publisher")
+	subs := make([]*dstp.Conn, 3)
+	for i := range subs {
+		subs[i] = loginHub(t, "fanout-subscriber")
+		subscribeHub(t, subs[i], "test/fanout")
+	}
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		sendHub(t, pub, "publish", map[string]any{"topic": "test/fanout", "data": "hello"})
+	}
+	for _, sub := range subs {
+		receivePublished(t, sub, "test/fanout", "fanout-publisher", n)
+	}
+}
+
+func TestHubRequiresLogin(t *testing.T) {
+	anon := connectHub(t)
+	sendHub(t, anon, "subscribe", map[string]any{"topic": "test/login"})
+	sub := loginHub(t, "login-subscriber")
+	subscribeHub(t, sub, "test/login")
+
+	// 登录的订阅者收到时，没有登录的连接应该在同一次转发中收到，实际上没有被订阅
+	pub := loginHub(t, "login-publisher")
+	sendHub(t, pub, "publish", map[string]any{"topic": "test/login", "data": "hello"})
+	receivePublished(t, sub, "test/login", "login-publisher", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
 	for {
-		data, _, err := dstpConn.Receive()
+		data, type_, err := anon.ReceiveContext(ctx)
 		if err != nil {
-			t.Error(err)
-		}
-		if TopicIsTest(data, dstpConn) {
-			once.Do(func() {
-				timeCount = time.Now()
-			})
-			count.Add(1)
-		}
-		//t.Log(count.Load())
-		if count.Load() == 10000 {
-			t.Log("received", count.Load(), "messages", "in", time.Since(timeCount))
 			break
 		}
+		if type_ == dstp.FrameMessage {
+			t.Fatalf("anonymous client received %s", data)
+		}
+	}
+}
+
+func TestHubMessagesInOrder(t *testing.T) {
+	// 重连恢复会话时连续发送登录和订阅，不等待登录的回复
+	conn := connectHub(t)
+	token, err := auth.GetToken("ordered", "user", "", "", testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendHub(t, conn, "login", map[string]any{"access_token": token})
+	sendHub(t, conn, "subscribe", map[string]any{"topic": "test/order"})
+	sendHub(t, conn, "publish", map[string]any{"topic": "test/order", "data": "hello"})
+	if msg := receiveHub(t, conn); msg.Option != "info" {
+		t.Fatalf("login: got %q", msg.Option)
 	}
+	receivePublished(t, conn, "test/order", "ordered", 1)
 }
 
-func TestReceive2(t *testing.T) {
-	t.Parallel()
+// receiveUpload 接收 from 按流发布的大块数据，返回 JSON 头之后的内容
+func receiveUpload(ctx context.Context, conn *dstp.Conn, from string) ([]byte, error) {
+	for {
+		got, type_, err := conn.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		line, rest, ok := bytes.Cut(got, []byte("\n"))
+		if type_ == dstp.FrameMessage && ok && bytes.Contains(line, []byte(`"from_user":"`+from+`"`)) {
+			return rest, nil
+		}
+	}
+}
 
-	wg := &sync.WaitGroup{}
+func TestHubStreamSlowSubscriber(t *testing.T) {
+	fast := streamHub(t, "stream-fast")
+	subscribeHub(t, fast, "test/stream")
+	// 没有握手的订阅者不支持流，hub 不转发大块数据
+	plain := loginHub(t, "stream-plain")
+	subscribeHub(t, plain, "test/stream")
+	// net.Pipe 的写入要等对方读取，这个订阅者在转发开始后暂停读取
+	a, b := net.Pipe()
+	testHub().ServeConn(a)
+	slow := dstp.NewConn(&b)
+	t.Cleanup(slow.Close)
+	handshakeHub(t, slow)
+	login(t, slow, "stream-slow")
+	subscribeHub(t, slow, "test/stream")
 
-	wg.Add(1)
+	// 按流发送，超过 hub 的单条消息长度限制，发布者在 Receive 中处理 hub 给出的信用
+	pub := streamHub(t, "stream-publisher")
 	go func() {
-		TestReceive(t)
-		wg.Done()
+		for {
+			if _, _, err := pub.Receive(); err != nil {
+				return
+			}
+		}
 	}()
+	data := bytes.Repeat([]byte("stream"), 5<<20/6)
+	head := []byte(`{"topic":"test/stream"}` + "\n")
+	sent := make(chan error, 1)
+	go func() { sent <- pub.SendStream(io.MultiReader(bytes.NewReader(head), bytes.NewReader(data))) }()
 
-	wg.Add(1)
+	// 转发按最慢的订阅者放慢，暂停读取的订阅者不会被跳过，两个订阅者都收到全部数据
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	type upload struct {
+		data []byte
+		err  error
+	}
+	uploads := make(chan upload, 2)
 	go func() {
-		TestReceive(t)
-		wg.Done()
+		got, err := receiveUpload(ctx, fast, "stream-publisher")
+		uploads <- upload{got, err}
 	}()
-
-	wg.Add(1)
 	go func() {
-		TestReceive(t)
-		wg.Done()
+		time.Sleep(time.Second)
+		got, err := receiveUpload(ctx, slow, "stream-publisher")
+		uploads <- upload{got, err}
 	}()
+	for range 2 {
+		u := <-uploads
+		if u.err != nil {
+			t.Fatal(u.err)
+		}
+		if !bytes.Equal(u.data, data) {
+			t.Fatalf("got %d bytes, want %d", len(u.data), len(data))
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
 
-	wg.Wait()
+	// 之后发布的普通消息是 plain 从发布者收到的第一条消息
+	sendHub(t, pub, "publish", map[string]any{"topic": "test/stream", "data": "hello"})
+	receivePublished(t, plain, "test/stream", "stream-publisher", 1)
 }
 
-func TopicIsTest(data []byte, conn *dstp.Conn) bool {
-	topic, _ := sonic.Get(data, "data", "topic")
-	topicStr, _ := topic.String()
-	option, _ := sonic.Get(data, "option")
-	optionStr, _ := option.String()
-	if optionStr == "ping" {
-		conn.Send([]byte("{\"option\":\"pong\"}"), true)
-	}
-	if topicStr == "test" {
-		return true
+func TestHubClosesClientNotReading(t *testing.T) {
+	// 客户端只发送不读取，回复填满发送队列后 hub 关闭连接，不会停止读取
+	a, b := net.Pipe()
+	testHub().ServeConn(a)
+	conn := dstp.NewConn(&b)
+	t.Cleanup(conn.Close)
+	msg, _ := json.Marshal(map[string]any{"option": "bogus"})
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if err := conn.Send(msg, false); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub stopped reading from a client that does not read replies")
 	}
-	return false
 }
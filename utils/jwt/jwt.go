@@ -37,6 +37,10 @@ func VerifyToken(tokenString string, secretKey string) (*JWTPayload, error) {
 	t, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return []byte(secretKey), nil
 	})
+	if err != nil {
+		// 格式错误的 token 解析失败时 t 为 nil
+		return nil, err
+	}
 
 	if claims, ok := t.Claims.(*JWTPayload); ok && t.Valid {
 		return claims, nil